@@ -2,8 +2,12 @@ package board
 
 import (
 	"fmt"
+	"io"
+	"math"
 	"math/bits"
 	"math/rand/v2"
+	"os"
+	"strconv"
 	"strings"
 )
 
@@ -137,9 +141,10 @@ func buildZobristKeys() Zobrist {
 // Build a Board object from a Forsyth-Edwards notation (FEN) string
 // example: "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1"
 func FromFen(fen string) (*Board, error) {
-	// TODO: apply halfmove count, move count
+	// TODO: apply move count
 	var color int
-	cb := &Board{}
+	// The en passant field may be missing
+	cb := &Board{EpSquare: 100}
 	square := int8(56)
 	firstSpace := strings.IndexByte(fen, ' ')
 	secondSpace := strings.IndexByte(fen[firstSpace+1:], ' ')
@@ -166,12 +171,20 @@ func FromFen(fen string) (*Board, error) {
 		} else {
 			color = 100 // placeholder value
 		}
+		if !strings.ContainsRune("pnbrqkPNBRQK12345678/", char) {
+			return cb, fmt.Errorf("invalid FEN character: %q", char)
+		}
 
-		switch {
-		case '1' <= char && char <= '8':
+		if '1' <= char && char <= '8' {
 			// Negate the "square += 1" at the end of the loop
 			square += int8(char-'0') - 1
 			squaresInRank += int(char - '0')
+		}
+		if squaresInRank > 8 {
+			return cb, fmt.Errorf("invalid FEN: %d squares in rank", squaresInRank)
+		}
+
+		switch {
 		case char == '/':
 			// Negate the "square += 1" at the end of the loop
 			square -= 17
@@ -225,6 +238,9 @@ func FromFen(fen string) (*Board, error) {
 
 		square += 1
 	}
+	if squaresInRank != 8 {
+		return cb, fmt.Errorf("invalid FEN: %d squares in rank", squaresInRank)
+	}
 
 	for i, char := range fen[firstSpace:] {
 		switch {
@@ -246,21 +262,32 @@ func FromFen(fen string) (*Board, error) {
 			cb.EpSquare = 100
 		case 'a' <= char && char <= 'h':
 			// rank 1: square=0+column, rank 2: square=8+column, ...
+			if i+firstSpace+1 == len(fen) || (fen[i+firstSpace+1] != '3' && fen[i+firstSpace+1] != '6') {
+				return cb, fmt.Errorf("invalid FEN en passant square")
+			}
 			rank := 8 * (int8(fen[i+firstSpace+1]-'0') - 1)
 			cb.EpSquare = (int8(char - 'a')) + rank
 		}
 	}
 
+	// Halfmove clock for the fifty-move rule, optional. Clocks past the
+	// fifty-move rule are legal, and stop at the largest uint8
+	if fields := strings.Fields(fen); len(fields) > 4 {
+		halfMoves, err := strconv.ParseUint(fields[4], 10, 32)
+		if err != nil {
+			return cb, fmt.Errorf("invalid FEN halfmove clock: %w", err)
+		}
+		cb.HalfMoves = uint8(min(halfMoves, math.MaxUint8))
+	}
+
 	cb.Pieces[0] = cb.Pawns[0] | cb.Knights[0] | cb.Bishops[0] |
 		cb.Rooks[0] | cb.Queens[0] | cb.Kings[0]
 	cb.Pieces[1] = cb.Pawns[1] | cb.Knights[1] | cb.Bishops[1] |
 		cb.Rooks[1] | cb.Queens[1] | cb.Kings[1]
 
 	// 24 is the max sum of piece phase values, as seen in the starting position
-	if cb.PiecePhaseSum < 0 {
-		panic("piece phase < 0")
-	} else if 24 < cb.PiecePhaseSum {
-		panic("piece phase > 24")
+	if 24 < cb.PiecePhaseSum {
+		return cb, fmt.Errorf("invalid FEN: piece phase %d > 24", cb.PiecePhaseSum)
 	}
 
 	cb.resetZobrist()
@@ -371,7 +398,50 @@ func RestorePosition(pos *Position, cb *Board) {
 	cb.EvalEndGamePST = pos.EvalEndGamePST
 }
 
+// State cleared by a null move, to be restored by UnmakeNullMove
+type NullMoveUndo struct {
+	EpSquare  int8
+	PrevMove  Move
+	HalfMoves uint8
+}
+
+// Pass the turn to the opponent. Flip the side to move, clear the en passant
+// square, and update the Zobrist hash
+func (cb *Board) MakeNullMove() NullMoveUndo {
+	undo := NullMoveUndo{EpSquare: cb.EpSquare, PrevMove: cb.PrevMove, HalfMoves: cb.HalfMoves}
+
+	if cb.EpSquare != 100 {
+		cb.Zobrist ^= ZobristKeys.EpFile[cb.EpSquare%8]
+		cb.EpSquare = 100
+	}
+	cb.PrevMove = Move{}
+	// Positions before a null move cannot repeat in a real game
+	cb.HalfMoves = 0
+	cb.WToMove ^= 1
+	cb.Zobrist ^= ZobristKeys.BToMove
+
+	return undo
+}
+
+// Take back a null move made by MakeNullMove
+func (cb *Board) UnmakeNullMove(undo NullMoveUndo) {
+	cb.WToMove ^= 1
+	cb.Zobrist ^= ZobristKeys.BToMove
+
+	cb.EpSquare = undo.EpSquare
+	if cb.EpSquare != 100 {
+		cb.Zobrist ^= ZobristKeys.EpFile[cb.EpSquare%8]
+	}
+	cb.PrevMove = undo.PrevMove
+	cb.HalfMoves = undo.HalfMoves
+}
+
 func (cb *Board) Print() {
+	cb.Fprint(os.Stdout)
+}
+
+// Write the board as text, rank 8 first, with white pieces in upper case
+func (cb *Board) Fprint(w io.Writer) {
 	// Possibly destructive to original cb, so print a copy
 	squares := [64]string{}
 	copied := StorePosition(cb)
@@ -401,16 +471,16 @@ func (cb *Board) Print() {
 
 	for i := 56; i != 7; i++ {
 		if squares[i] == "" {
-			fmt.Print("- ")
+			fmt.Fprint(w, "- ")
 		} else {
-			fmt.Printf("%s ", squares[i])
+			fmt.Fprintf(w, "%s ", squares[i])
 		}
 		if i%8 == 7 {
 			i -= 16
-			fmt.Println()
+			fmt.Fprintln(w)
 		}
 	}
-	fmt.Println(squares[7])
+	fmt.Fprintln(w, squares[7])
 }
 
 // Set cb.EvalMidGamePST and cb.EvalEndGamePST
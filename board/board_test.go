@@ -89,6 +89,14 @@ func TestFromFen(t *testing.T) {
 		t.Errorf("cb.EpSquare: want=16, got=%d\n", cb.EpSquare)
 	}
 
+	cb, err = FromFen("4k3/8/8/8/8/8/4P3/4K3 w K")
+	if err != nil {
+		t.Error(err)
+	}
+	if cb.EpSquare != 100 {
+		t.Errorf("missing en passant field: want EpSquare=100, got=%d\n", cb.EpSquare)
+	}
+
 	// Test cb.PiecePhaseSum
 	expected := 0
 	if cb.PiecePhaseSum != expected {
@@ -114,6 +122,49 @@ func TestFromFen(t *testing.T) {
 	}
 }
 
+func TestFromFenInvalid(t *testing.T) {
+	fens := []string{
+		"",
+		"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP w KQkq - 0 1",
+		"rnbqkbnr/pppppppp/9/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1",
+		"rnbqkbnr/ppppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1",
+		"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBN w KQkq - 0 1",
+		"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNX w KQkq - 0 1",
+		"8/17/8/8/8/8/8/ 0 a",
+		"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq e",
+		"qqqqkqqq/8/8/8/8/8/8/QQQQKQQQ w - - 0 1",
+		"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - x 1",
+	}
+	for _, fen := range fens {
+		if _, err := FromFen(fen); err == nil {
+			t.Errorf("%q: want an error", fen)
+		}
+	}
+}
+
+func TestFromFenHalfMoves(t *testing.T) {
+	tests := []struct {
+		fen  string
+		want uint8
+	}{
+		{"4k3/8/8/8/8/8/8/4K3 w - - 37 60", 37},
+		// Clocks which do not fit a uint8 stop at its largest value
+		{"4k3/8/8/8/8/8/8/4K3 w - - 255 200", 255},
+		{"4k3/8/8/8/8/8/8/4K3 w - - 300 200", 255},
+		// The move counters are optional
+		{"4k3/8/8/8/8/8/8/4K3 w - -", 0},
+	}
+	for _, tt := range tests {
+		cb, err := FromFen(tt.fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cb.HalfMoves != tt.want {
+			t.Errorf("%q: want HalfMoves=%d, got %d", tt.fen, tt.want, cb.HalfMoves)
+		}
+	}
+}
+
 func TestResetZobrist(t *testing.T) {
 	cb, err := FromFen("r3k3/8/8/8/8/8/8/R3K2R w KQq - 0 1")
 	if err != nil {
@@ -132,6 +183,35 @@ func TestResetZobrist(t *testing.T) {
 	}
 }
 
+func TestNullMove(t *testing.T) {
+	fens := []string{
+		"rnbqkbnr/pppp1ppp/8/8/3pP3/8/PPP2PPP/RNBQKBNR b KQkq e3 0 3",
+		"r3k3/8/8/8/8/8/8/R3K2R w KQq - 0 1",
+	}
+	for _, fen := range fens {
+		cb, err := FromFen(fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := *cb
+		undo := cb.MakeNullMove()
+
+		if cb.WToMove == before.WToMove || cb.EpSquare != 100 {
+			t.Errorf("%q: side or en passant square not updated", fen)
+		}
+		want := cb.Zobrist
+		cb.resetZobrist()
+		if want != cb.Zobrist {
+			t.Errorf("%q: null move zobrist: want=%d, got=%d", fen, cb.Zobrist, want)
+		}
+
+		cb.UnmakeNullMove(undo)
+		if *cb != before {
+			t.Errorf("%q: unmake: want=%+v, got=%+v", fen, before, *cb)
+		}
+	}
+}
+
 func TestResetMidGameEndGamePST(t *testing.T) {
 	cb, err := FromFen("rnbqkp2/8/8/8/8/8/RNBQKP2/8 w Qq - 0 1")
 	if err != nil {
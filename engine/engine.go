@@ -3,150 +3,703 @@ package engine
 
 import (
 	"bytes"
-	"fmt"
 	"github.com/j1642/chess-engine-2/board"
+	"github.com/j1642/chess-engine-2/moves"
 	"github.com/j1642/chess-engine-2/pieces"
+	"math"
 	"math/bits"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type TtEntry struct {
-	Hash                 uint64
-	Eval                 int
-	Move                 board.Move
-	NodeType, Age, Depth uint8
-}
-
 const (
 	MATE                = 1 << 20
-	ORIG_HASH_CAP       = 1 << 20
+	INFINITY            = 1 << 30
 	MAX_PHASE           = pieces.MAX_PHASE
 	MAX_PIECE_PHASE_SUM = 24
 
 	PV_NODE  = uint8(0)
 	ALL_NODE = uint8(1)
 	CUT_NODE = uint8(2)
+
+	DEFAULT_THREADS = 1
+	MAX_THREADS     = 256
+	// Threads check the stop flag once per this many nodes
+	STOP_CHECK_NODES = 1024
+	// Depth of a search limited only by time
+	MAX_SEARCH_DEPTH = 64
+	// Deepest ply reached, including extensions and quiescence. Being mated
+	// at ply p scores -MATE + p, so scores beyond MATE - MAX_PLY are mates
+	MAX_PLY = 2 * MAX_SEARCH_DEPTH
+	// Score of a drawn position, before contempt
+	DRAW = 0
+	// Centipawns by which the root side to move values a draw below DRAW
+	DEFAULT_CONTEMPT = 0
+	MAX_CONTEMPT     = 100
+	// Halfmoves without a capture or pawn move which draw the game
+	FIFTY_MOVE_PLIES = 100
+	// Number of best root moves to report
+	DEFAULT_MULTI_PV = 1
+	MAX_MULTI_PV     = 256
+
+	// Iterations from this depth start with a window of the previous score
+	// +-ASPIRATION_WINDOW. The window doubles on each fail low or fail high,
+	// and becomes infinite after ASPIRATION_MAX_WINDOW
+	ASPIRATION_MIN_DEPTH  = 4
+	ASPIRATION_WINDOW     = 50
+	ASPIRATION_MAX_WINDOW = 1000
+
+	// Null-move pruning searches from this depth, with a reduction of
+	// NULL_MOVE_REDUCTION, or one more from NULL_MOVE_DEEP_DEPTH. From
+	// NULL_MOVE_VERIFY_DEPTH, a null-move cutoff is verified by a reduced
+	// search without null moves, so that zugzwang is not mis-scored
+	NULL_MOVE_MIN_DEPTH    = 3
+	NULL_MOVE_REDUCTION    = 2
+	NULL_MOVE_DEEP_DEPTH   = 7
+	NULL_MOVE_VERIFY_DEPTH = 6
+
+	// Quiet moves are searched with a reduced depth from LMR_MIN_DEPTH, after
+	// LMR_MIN_MOVES legal moves. The reduction grows with the logarithms of
+	// depth and move number, see lmrReductions, and is one ply less at PV nodes
+	LMR_MIN_DEPTH = 3
+	LMR_MIN_MOVES = 3
+	// Late move pruning skips quiet moves at non-PV nodes at depths up to
+	// LMP_MAX_DEPTH, after LMP_BASE_MOVES + depth*depth legal moves
+	LMP_MAX_DEPTH  = 3
+	LMP_BASE_MOVES = 3
+
+	// Most plies a line may be extended by, net of reductions
+	MAX_EXTENSIONS = 8
+	// The first move is singular, and extended, if its TT lower bound minus
+	// SINGULAR_MARGIN per ply of depth beats every other move in a search at
+	// half depth. Tried from SINGULAR_MIN_DEPTH, with a TT entry at most
+	// SINGULAR_TT_DEPTH plies shallower than the node
+	SINGULAR_MIN_DEPTH = 6
+	SINGULAR_TT_DEPTH  = 3
+	SINGULAR_MARGIN    = 2
+
+	// Reverse futility pruning, futility pruning and razoring apply at
+	// depths up to FUTILITY_MAX_DEPTH, see margins
+	FUTILITY_MAX_DEPTH = 3
 )
 
-var tTable = make(map[uint64]TtEntry, ORIG_HASH_CAP)
-var Negamax = negamax
 var emptyMove = board.Move{}
 
-func negamax(alpha, beta, depth int, cb *board.Board, orig_depth int, orig_age uint8, parentPartialPV *[]board.Move, completePV *pvLine) (int, board.Move) {
+// Search techniques which can be disabled to measure their effect
+type searchFeatures struct {
+	pvs        bool
+	aspiration bool
+	nullMove   bool
+	lmr        bool
+	lmp        bool
+	// Killer, countermove and history move ordering
+	ordering   bool
+	extensions bool
+	// Reverse futility pruning, futility pruning and razoring
+	futility bool
+}
+
+var features = searchFeatures{pvs: true, aspiration: true, nullMove: true, lmr: true, lmp: true, ordering: true, extensions: true, futility: true}
+
+// Margins in centipawns of the pruning near the leaves, indexed by depth.
+// Variables so that they can be tuned
+type pruningMargins struct {
+	// Prune a non-PV node if the static eval beats beta by this much
+	reverseFutility [FUTILITY_MAX_DEPTH + 1]int
+	// Prune quiet moves if the static eval plus this does not reach alpha
+	futility [FUTILITY_MAX_DEPTH + 1]int
+	// Drop a non-PV node into quiescence if the static eval plus this does not
+	// reach alpha
+	razoring [FUTILITY_MAX_DEPTH + 1]int
+}
+
+var margins = pruningMargins{
+	reverseFutility: [FUTILITY_MAX_DEPTH + 1]int{0, 100, 200, 300},
+	futility:        [FUTILITY_MAX_DEPTH + 1]int{0, 150, 300, 450},
+	razoring:        [FUTILITY_MAX_DEPTH + 1]int{0, 300, 500, 700},
+}
+
+// Late move reductions, indexed by [depth][legal moves searched]
+var lmrReductions = buildLMRReductions()
+
+func buildLMRReductions() [MAX_SEARCH_DEPTH + 1][64]int {
+	var reductions [MAX_SEARCH_DEPTH + 1][64]int
+	for depth := 1; depth <= MAX_SEARCH_DEPTH; depth++ {
+		for moveNum := 1; moveNum < 64; moveNum++ {
+			reductions[depth][moveNum] = int(0.75 + math.Log(float64(depth))*math.Log(float64(moveNum))/2.25)
+		}
+	}
+	return reductions
+}
+
+// Search state of one thread. Thread 0 is the main thread, which reports the
+// result. Lazy SMP helper threads search copies of the board and communicate
+// with the main thread only through the shared transposition table
+type searchThread struct {
+	id    int
+	tt    *TranspositionTable
+	nodes atomic.Uint64
+	// Set when the threads should unwind their searches: by the main thread
+	// when it finishes, or by the hard time limit
+	stop    *atomic.Bool
+	aborted bool
+	// Maximum number of nodes to search, 0 for no limit
+	nodeLimit uint64
+	// Best root move and eval of the current iteration so far
+	rootMove board.Move
+	rootEval int
+	// Root moves which are not searched, because MultiPV already found them
+	excludedRootMoves []board.Move
+	// If not nil, the only root moves which are searched
+	searchMoves []board.Move
+	// Statistics which are only read by the thread itself
+	stats SearchStats
+	// Highest ply reached in the current iteration, including quiescence
+	selDepth int
+	// If not nil, called before each root move is searched
+	onRootMove func(depth int, move board.Move, number int)
+	// Set before searching a node which must not try a null move, because
+	// it follows a null move or verifies a null-move cutoff
+	noNullMove bool
+	// Killers, history and countermoves
+	ordering *moveOrdering
+	// Set before a singular extension search, which skips this move
+	excludedMove board.Move
+	// Depth of the current root search, to count the extensions of a line
+	rootDepth int
+	// Zobrist hashes of the game before the root, then of the current search
+	// path, oldest first. The position at ply p is at index historyLen+p, so
+	// a re-search of a node at the same ply overwrites its own key
+	keys []uint64
+	// Number of positions of the game before the root
+	historyLen int
+	// Draw score for the root side to move is -contempt
+	contempt int
+}
+
+func newSearchThread(id int, tt *TranspositionTable, stop *atomic.Bool) *searchThread {
+	return &searchThread{id: id, tt: tt, stop: stop, ordering: &moveOrdering{}}
+}
+
+// Count a visited node. Return true if the thread has been told to stop, in
+// which case the caller returns immediately
+func (st *searchThread) countNode() bool {
+	if st.nodeLimit != 0 && st.nodes.Load() >= st.nodeLimit {
+		st.aborted = true
+	}
+	if st.aborted {
+		return true
+	}
+	nodes := st.nodes.Add(1)
+	if nodes%STOP_CHECK_NODES == 0 && st.stop.Load() {
+		st.aborted = true
+	}
+	return st.aborted
+}
+
+func (st *searchThread) negamax(alpha, beta, depth int, cb *board.Board, ply int, parentPartialPV *[]board.Move, completePV *pvLine) (int, board.Move) {
+	// Consume the flags here so they do not leak into sibling nodes
+	allowNullMove := !st.noNullMove
+	st.noNullMove = false
+	excludedMove := st.excludedMove
+	st.excludedMove = emptyMove
+	if ply != 0 && st.isDraw(cb, ply) && !isCheckmated(cb) {
+		return st.drawScore(ply), emptyMove
+	}
 	if depth == 0 {
-		return quiesce(alpha, beta, cb), cb.PrevMove
+		return st.quiesce(alpha, beta, cb, ply), cb.PrevMove
+	}
+	if ply == 0 {
+		st.rootDepth = depth
+	}
+	if st.countNode() {
+		return 0, emptyMove
+	}
+	st.stats.SearchNodes++
+	if ply != 0 {
+		// Mate distance pruning: no line from here scores above mating on the
+		// next ply, or below being mated right here. Beta stays one above the
+		// best mate, so that the mating move is still searched as a PV move
+		alpha = max(alpha, -MATE+ply)
+		beta = min(beta, MATE-ply)
+		if alpha >= beta {
+			return alpha, emptyMove
+		}
 	}
+	st.keys = append(st.keys[:st.historyLen+ply], cb.Zobrist)
 	var bestMove board.Move
 	var score int
 	pos := board.StorePosition(cb)
+	st.selDepth = max(st.selDepth, ply)
+	// Legal moves searched so far
+	searched := 0
+	// With PVS, only the first move searched gets the full window
+	fullWindow := true
 
 	moves := pieces.GetAllMoves(cb)
 	if len(moves) == 0 {
 		// End of branch when depth > 0, checkmate or stalemate
-		score = -MATE
-		// Negamax evaluations are relative to the side to move. Regardless of
-		// the side to move, being in checkmate is bad, and is a negative score
-		return score, cb.PrevMove
+		return st.noMovesScore(cb, ply), cb.PrevMove
 	}
 
+	// Moves before this index are already ordered
+	ordered := 0
 	// if a PV move exists for this depth and it has not been used yet
-	if len(completePV.moves) > 0 && orig_depth > 1 && depth > 1 && len(completePV.moves) >= orig_depth-depth && !(completePV.alreadyUsed)[orig_depth-depth] {
-		pvMove := completePV.moves[orig_depth-depth]
-		// Linear search confirms the move exists, remove eventually?
-		foundPvMode := false
+	if len(completePV.moves) > ply && len(completePV.alreadyUsed) > ply && depth > 1 && !completePV.alreadyUsed[ply] {
+		pvMove := completePV.moves[ply]
+		// The PV move may be missing when a cutoff at a shallower ply, like a
+		// null-move cutoff, skipped the PV node. Then this node is not on the
+		// PV and keeps its move order
 		for i, move := range moves {
 			if move == pvMove {
-				foundPvMode = true
 				moves[0], moves[i] = moves[i], moves[0]
-				completePV.alreadyUsed[orig_depth-depth] = true
+				completePV.alreadyUsed[ply] = true
+				ordered = 1
 				break
 			}
 		}
-		if !foundPvMode {
-			panic("invalid move in this position")
+	}
+
+	inCheck := isInCheck(cb)
+	// PV nodes are searched with an open window, other nodes with a zero window
+	pvNode := beta-alpha > 1
+	// Near the leaves, the static eval decides if the node or its quiet moves
+	// are hopeless. PV nodes are never cut short on the static eval
+	futile := false
+	if features.futility && ply != 0 && depth <= FUTILITY_MAX_DEPTH && !inCheck && excludedMove == emptyMove {
+		staticEval := evaluate(cb)
+		if !pvNode && staticEval-margins.reverseFutility[depth] >= beta && !isMateScore(beta) {
+			return beta, emptyMove
+		}
+		// Quiescence does not search checks, so nodes with a checking move
+		// are not razored
+		if !pvNode && staticEval+margins.razoring[depth] <= alpha && !isMateScore(alpha) && !hasCheckingMove(moves, cb, pos) {
+			if score := st.quiesce(alpha, alpha+1, cb, ply); score <= alpha || st.aborted {
+				return alpha, emptyMove
+			}
 		}
+		futile = staticEval+margins.futility[depth] <= alpha && !isMateScore(alpha)
+	}
+
+	if allowNullMove && ply != 0 && st.nullMoveCutoff(beta, depth, cb, ply) {
+		return beta, emptyMove
+	}
+
+	if features.ordering {
+		st.ordering.order(moves, cb, ply, ordered)
 	}
 
 	line := make([]board.Move, 0)
+	singleReply := inCheck && countLegalMoves(moves, cb, pos) == 1
+	// Quiet moves searched so far, which lose history if a later quiet move
+	// causes a cutoff
+	quietsSearched := make([]board.Move, 0, len(moves))
 
 	for _, move := range moves {
 		if move == emptyMove {
 			panic("cannot do an empty move")
 		}
+		if ply == 0 && !st.isRootMoveSearched(move) || move == excludedMove {
+			continue
+		}
+		quiet := isQuiet(move, cb)
+		passedPawnPush := isPassedPawnPush(move, cb)
 		pieces.MovePiece(move, cb)
 		// Check legality of pseudo-legal moves. King moves are strictly legal already
 		if move.Piece == pieces.KING || cb.Kings[1^cb.WToMove]&pieces.GetAttackedSquares(cb) == 0 {
-			if stored, ok := tTable[cb.Zobrist]; ok {
-				// If no pv nodes are stored, is it ok to always used cached
-				// nodes regardless of relative depths?
-				if stored.Hash == cb.Zobrist && stored.Depth >= uint8(depth) {
+			searched++
+			if ply == 0 && st.onRootMove != nil {
+				st.onRootMove(depth, move, searched)
+			}
+			givesCheck := isInCheck(cb)
+			// Late quiet moves are unlikely to be best, so they may be pruned
+			// or reduced. Never when escaping check or giving check
+			late := quiet && searched > 1 && ply != 0 && !inCheck &&
+				!st.ordering.isKiller(ply, move) && !givesCheck
+			if late && !pvNode && features.lmp && depth <= LMP_MAX_DEPTH && searched > LMP_BASE_MOVES+depth*depth && !isMateScore(alpha) {
+				board.RestorePosition(pos, cb)
+				continue
+			}
+			if futile && quiet && searched > 1 && !givesCheck {
+				board.RestorePosition(pos, cb)
+				continue
+			}
+			stored, ok := st.tt.Probe(cb.Zobrist)
+			st.stats.TTProbes++
+			if ok {
+				st.stats.TTHits++
+			}
+			ttEval := scoreFromTT(stored.Eval, ply)
+			if ok && stored.Depth >= uint8(depth) {
+				// Evals depend on the window they were searched with. A CUT_NODE
+				// eval is a lower bound and an ALL_NODE eval is an upper bound,
+				// so they only decide this node if they fall outside its window
+				switch stored.NodeType {
+				case CUT_NODE:
+					if ttEval >= beta {
+						board.RestorePosition(pos, cb)
+						return ttEval, stored.Move
+					}
+				case ALL_NODE:
+					if ttEval <= alpha {
+						board.RestorePosition(pos, cb)
+						continue
+					}
+				case PV_NODE:
 					board.RestorePosition(pos, cb)
-					switch stored.NodeType {
-					case CUT_NODE:
-						return stored.Eval, stored.Move
-					case ALL_NODE:
-					case PV_NODE:
-						if stored.Eval >= beta {
-							return beta, move
-						} else if stored.Eval > alpha {
-							alpha = stored.Eval
-						}
-
-						// PV block
-						if len(*parentPartialPV) == 0 {
-							*parentPartialPV = append(*parentPartialPV, move)
-						} else {
-							(*parentPartialPV)[0] = move
-						}
-						for i := range line {
-							if len(*parentPartialPV) <= i+1 {
-								*parentPartialPV = append(*parentPartialPV, line[i])
-							} else {
-								(*parentPartialPV)[1+i] = line[i]
-							}
-						}
-					default:
-						panic("invalid node type")
+					if ttEval >= beta {
+						return beta, move
+					} else if ttEval > alpha {
+						alpha = ttEval
 					}
+
+					updatePV(parentPartialPV, move, line)
 					continue
-				} else {
-					delete(tTable, cb.Zobrist)
+				default:
+					panic("invalid node type")
 				}
 			}
-			score, _ = negamax(-1*beta, -1*alpha, depth-1, cb, orig_depth, orig_age, &line, completePV)
-			score *= -1
+
+			// Extend forcing moves, and a first move much better than the rest
+			extension := 0
+			if features.extensions && ply != 0 && st.canExtend(ply, depth) {
+				switch {
+				case givesCheck || singleReply || passedPawnPush:
+					extension = 1
+				case searched == 1 && depth >= SINGULAR_MIN_DEPTH && ok && stored.NodeType == CUT_NODE &&
+					int(stored.Depth) >= depth-SINGULAR_TT_DEPTH && excludedMove == emptyMove &&
+					!isMateScore(ttEval):
+					board.RestorePosition(pos, cb)
+					if st.isSingular(move, ttEval, depth, cb, ply) {
+						extension = 1
+					}
+					pieces.MovePiece(move, cb)
+				}
+			}
+			childDepth := depth - 1 + extension
+
+			if fullWindow || !features.pvs {
+				score, _ = st.negamax(-1*beta, -1*alpha, childDepth, cb, ply+1, &line, completePV)
+				score *= -1
+				fullWindow = false
+			} else {
+				// Prove the move is no better than alpha with a zero window. If
+				// it is better, search it again for an exact score
+				reduction := 0
+				if late && features.lmr && depth >= LMR_MIN_DEPTH && searched > LMR_MIN_MOVES {
+					reduction = lmrReductions[depth][min(searched, 63)]
+					if pvNode {
+						// The PV decides the result, so its moves are reduced less
+						reduction--
+					}
+					reduction = max(0, min(reduction, childDepth-1))
+				}
+				score, _ = st.negamax(-alpha-1, -alpha, childDepth-reduction, cb, ply+1, &line, completePV)
+				score *= -1
+				if reduction > 0 && score > alpha && !st.aborted {
+					score, _ = st.negamax(-alpha-1, -alpha, childDepth, cb, ply+1, &line, completePV)
+					score *= -1
+				}
+				if score > alpha && score < beta && !st.aborted {
+					score, _ = st.negamax(-1*beta, -1*alpha, childDepth, cb, ply+1, &line, completePV)
+					score *= -1
+				}
+			}
+			if st.aborted {
+				board.RestorePosition(pos, cb)
+				return 0, emptyMove
+			}
+			if quiet {
+				quietsSearched = append(quietsSearched, move)
+			}
 
 			if score >= beta {
-				tTable[cb.Zobrist] = TtEntry{Hash: cb.Zobrist, Eval: beta, Age: orig_age, Move: move, NodeType: CUT_NODE, Depth: uint8(depth)}
+				st.stats.BetaCutoffs++
+				if searched == 1 {
+					st.stats.FirstMoveCutoffs++
+				}
+				st.tt.Store(cb.Zobrist, TtEntry{Eval: scoreToTT(beta, ply), Move: move, NodeType: CUT_NODE, Depth: uint8(depth)})
 				board.RestorePosition(pos, cb)
+				if quiet {
+					st.ordering.updateQuietCutoff(cb, move, ply, depth, quietsSearched)
+				}
 				return beta, move
 			} else if score > alpha {
 				alpha = score
 				bestMove = move
-				//tTable[cb.Zobrist] = TtEntry{Hash: cb.Zobrist, Eval: score, Age: orig_age, Move: bestMove, NodeType: PV_NODE, Depth: uint8(depth)}
+				//st.tt.Store(cb.Zobrist, TtEntry{Eval: score, Move: bestMove, NodeType: PV_NODE, Depth: uint8(depth)})
 
-				// PV block
-				if len(*parentPartialPV) == 0 {
-					*parentPartialPV = append(*parentPartialPV, move)
-				} else {
-					(*parentPartialPV)[0] = move
-				}
-				for i := range line {
-					if len(*parentPartialPV) <= i+1 {
-						*parentPartialPV = append(*parentPartialPV, line[i])
-					} else {
-						(*parentPartialPV)[1+i] = line[i]
-					}
+				updatePV(parentPartialPV, move, line)
+				if ply == 0 {
+					st.rootEval, st.rootMove = score, move
 				}
 			} else {
-				tTable[cb.Zobrist] = TtEntry{Hash: cb.Zobrist, Eval: score, Age: orig_age, Move: bestMove, NodeType: ALL_NODE, Depth: uint8(depth)}
+				st.tt.Store(cb.Zobrist, TtEntry{Eval: scoreToTT(score, ply), Move: bestMove, NodeType: ALL_NODE, Depth: uint8(depth)})
 			}
 		}
 		board.RestorePosition(pos, cb)
 	}
+	if searched == 0 && excludedMove == emptyMove && ply != 0 {
+		// Every pseudo-legal move was illegal
+		return st.noMovesScore(cb, ply), cb.PrevMove
+	}
 
 	return alpha, bestMove
 }
 
+// Score a position without legal moves. Negamax evaluations are relative to
+// the side to move. Regardless of the side to move, being in checkmate is
+// bad, and is a negative score. Later mates are less bad
+func (st *searchThread) noMovesScore(cb *board.Board, ply int) int {
+	if isInCheck(cb) {
+		return -MATE + ply
+	}
+	// Stalemate
+	return st.drawScore(ply)
+}
+
+// Return the score of a draw for the side to move at ply. With contempt, the
+// root side to move avoids draws, and so its opponent seeks them
+func (st *searchThread) drawScore(ply int) int {
+	if ply%2 == 0 {
+		return DRAW - st.contempt
+	}
+	return DRAW + st.contempt
+}
+
+// Return true if the position is drawn by the fifty-move rule or by
+// insufficient material, or repeats a position of the game or of the search
+// path up to ply
+func (st *searchThread) isDraw(cb *board.Board, ply int) bool {
+	if cb.HalfMoves >= FIFTY_MOVE_PLIES || isInsufficientMaterial(cb) {
+		return true
+	}
+	// Only positions since the last capture or pawn move can repeat, and
+	// only those with the same side to move
+	keys := st.keys[:st.historyLen+ply]
+	oldest := len(keys) - int(cb.HalfMoves)
+	for i := len(keys) - 4; i >= max(oldest, 0); i -= 2 {
+		if keys[i] == cb.Zobrist {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if neither side can checkmate: king against king and at most
+// one minor piece, or bishops which all stand on squares of one color
+func isInsufficientMaterial(cb *board.Board) bool {
+	for color := range 2 {
+		if cb.Pawns[color]|cb.Rooks[color]|cb.Queens[color] != 0 {
+			return false
+		}
+	}
+	knights := cb.Knights[0] | cb.Knights[1]
+	bishops := cb.Bishops[0] | cb.Bishops[1]
+	if bits.OnesCount64(knights|bishops) <= 1 {
+		return true
+	}
+	const lightSquares = 0x55aa55aa55aa55aa
+	return knights == 0 && (bishops&lightSquares == 0 || bishops&^lightSquares == 0)
+}
+
+// Checkmate ends the game before a repetition or the fifty-move rule does
+func isCheckmated(cb *board.Board) bool {
+	return isInCheck(cb) && len(pieces.GetLegalMoves(cb)) == 0
+}
+
+// Return true if the line to this node may be extended by another ply
+func (st *searchThread) canExtend(ply, depth int) bool {
+	// Without extensions, ply + depth equals the root depth, or less after
+	// reductions
+	return ply+depth-st.rootDepth < MAX_EXTENSIONS && ply+depth < MAX_SEARCH_DEPTH
+}
+
+// Return true if every move except move fails low against its TT lower bound
+// minus a margin, in a search at half depth. Then move is the only good move
+func (st *searchThread) isSingular(move board.Move, ttEval, depth int, cb *board.Board, ply int) bool {
+	singularBeta := ttEval - SINGULAR_MARGIN*depth
+	line := make([]board.Move, 0)
+	st.excludedMove = move
+	st.noNullMove = true
+	score, _ := st.negamax(singularBeta-1, singularBeta, (depth-1)/2, cb, ply, &line, &pvLine{})
+	st.excludedMove = emptyMove
+	st.noNullMove = false
+	return !st.aborted && score < singularBeta
+}
+
+// Return the number of legal moves among pseudo-legal moves
+func countLegalMoves(moves []board.Move, cb *board.Board, pos *board.Position) int {
+	legal := 0
+	for _, move := range moves {
+		pieces.MovePiece(move, cb)
+		if move.Piece == pieces.KING || cb.Kings[1^cb.WToMove]&pieces.GetAttackedSquares(cb) == 0 {
+			legal++
+		}
+		board.RestorePosition(pos, cb)
+	}
+	return legal
+}
+
+// Return true if one of the pseudo-legal moves gives check
+func hasCheckingMove(moves []board.Move, cb *board.Board, pos *board.Position) bool {
+	for _, move := range moves {
+		pieces.MovePiece(move, cb)
+		check := isInCheck(cb)
+		board.RestorePosition(pos, cb)
+		if check {
+			return true
+		}
+	}
+	return false
+}
+
+// Return true if the move pushes a pawn to its seventh rank. No enemy pawn
+// can stop it there, so it is always passed
+func isPassedPawnPush(move board.Move, cb *board.Board) bool {
+	seventhRank := [2]int8{1, 6}[cb.WToMove]
+	return move.Piece == pieces.PAWN && move.To/8 == seventhRank
+}
+
+// Return true if the score is a mate score or beyond, which static evals and
+// their margins cannot be compared to
+func isMateScore(score int) bool {
+	return abs(score) >= MATE-MAX_PLY
+}
+
+// Convert a score relative to the root into one relative to the node at ply,
+// for the transposition table. The same position can be found at other plies
+func scoreToTT(score, ply int) int {
+	switch {
+	case score >= MATE-MAX_PLY && score <= MATE:
+		return score + ply
+	case score <= -MATE+MAX_PLY && score >= -MATE:
+		return score - ply
+	}
+	return score
+}
+
+// Convert a transposition table score into one relative to the root
+func scoreFromTT(score, ply int) int {
+	switch {
+	case score >= MATE-MAX_PLY && score <= MATE:
+		return score - ply
+	case score <= -MATE+MAX_PLY && score >= -MATE:
+		return score + ply
+	}
+	return score
+}
+
+// Return true if the move is not a capture or a promotion
+func isQuiet(move board.Move, cb *board.Board) bool {
+	if move.PromoteTo != pieces.NO_PIECE {
+		return false
+	}
+	if move.Piece == pieces.PAWN && move.To == cb.EpSquare {
+		return false
+	}
+	return cb.Pieces[1^cb.WToMove]&(1<<move.To) == 0
+}
+
+// Return true if the side to move is in check
+func isInCheck(cb *board.Board) bool {
+	_, checks := pieces.GetCheckingSquares(cb)
+	return checks != 0
+}
+
+// Return true if passing the turn still fails high, so that the node can be
+// pruned. Skipped when in check, when the side to move has only pawns, where
+// zugzwang is common, and when beta is a mate score
+func (st *searchThread) nullMoveCutoff(beta, depth int, cb *board.Board, ply int) bool {
+	if !features.nullMove || depth < NULL_MOVE_MIN_DEPTH || isMateScore(beta) {
+		return false
+	}
+	us := cb.WToMove
+	if cb.Knights[us]|cb.Bishops[us]|cb.Rooks[us]|cb.Queens[us] == 0 {
+		return false
+	}
+	if _, checks := pieces.GetCheckingSquares(cb); checks != 0 {
+		return false
+	}
+	if evaluate(cb) < beta {
+		return false
+	}
+
+	reduction := NULL_MOVE_REDUCTION
+	if depth >= NULL_MOVE_DEEP_DEPTH {
+		reduction++
+	}
+	// The null-move subtree is not on the PV
+	line := make([]board.Move, 0)
+	emptyPV := &pvLine{}
+
+	undo := cb.MakeNullMove()
+	st.noNullMove = true
+	score, _ := st.negamax(-beta, -beta+1, max(depth-1-reduction, 0), cb, ply+1, &line, emptyPV)
+	st.noNullMove = false
+	cb.UnmakeNullMove(undo)
+	score *= -1
+	if st.aborted || score < beta {
+		return false
+	}
+
+	if depth >= NULL_MOVE_VERIFY_DEPTH {
+		st.noNullMove = true
+		score, _ = st.negamax(beta-1, beta, depth-reduction, cb, ply, &line, emptyPV)
+		st.noNullMove = false
+		if st.aborted || score < beta {
+			return false
+		}
+	}
+	return true
+}
+
+// Search the root with a window around the previous iteration's eval, and
+// widen it until the eval falls inside
+func (st *searchThread) aspirationSearch(cb *board.Board, depth, prevEval int, hasPrevEval bool, line *[]board.Move, completePV *pvLine) (int, board.Move) {
+	alpha, beta := -INFINITY, INFINITY
+	delta := ASPIRATION_WINDOW
+	if features.aspiration && hasPrevEval && depth >= ASPIRATION_MIN_DEPTH && !isMateScore(prevEval) {
+		alpha, beta = prevEval-delta, prevEval+delta
+	}
+	for {
+		st.rootMove = emptyMove
+		eval, move := st.negamax(alpha, beta, depth, cb, 0, line, completePV)
+		switch {
+		case st.aborted:
+			return eval, move
+		case eval <= alpha && alpha != -INFINITY:
+			alpha -= delta
+		case eval >= beta && beta != INFINITY:
+			beta += delta
+		default:
+			return eval, move
+		}
+		delta *= 2
+		if delta > ASPIRATION_MAX_WINDOW {
+			alpha, beta = -INFINITY, INFINITY
+		}
+		// The PV moves are used again in the next search
+		clear(completePV.alreadyUsed)
+	}
+}
+
+// Return false if go searchmoves or MultiPV excludes a root move
+func (st *searchThread) isRootMoveSearched(move board.Move) bool {
+	if st.searchMoves != nil && !slices.Contains(st.searchMoves, move) {
+		return false
+	}
+	return !slices.Contains(st.excludedRootMoves, move)
+}
+
+// Replace the PV with move followed by the child's PV. A shorter PV must not
+// keep moves from the previous one, which may be illegal in this line
+func updatePV(pv *[]board.Move, move board.Move, childPV []board.Move) {
+	*pv = append(append((*pv)[:0], move), childPV...)
+}
+
 // Return position evaluation in centipawns (0.01 pawns)
 func evaluate(cb *board.Board) int {
 	// TODO: king safety, rooks on (semi-)open files, bishop pair (>= 2),
@@ -178,63 +731,43 @@ func evaluate(cb *board.Board) int {
 	return eval
 }
 
-// Return evaluation of doubled, blocked, and isolated pawns.
+// Return evaluation of doubled, blocked, isolated, and passed pawns.
 func evalPawns(cb *board.Board) int {
 	eval := 0
-	pawnsInFile := [2][8]int{} // first index is [black, white]
-
-	// Blocked pawns and tapered pawn piece-square table
 	occupied := cb.Pieces[0] | cb.Pieces[1]
-	wPawns := cb.Pawns[1]
-	square := 0
-	for wPawns > 0 {
-		square = bits.TrailingZeros64(wPawns)
-		pawnsInFile[1][square%8] += 1
-		if uint64(1<<(square+8))&occupied != 0 {
-			eval -= 50
-		}
-		wPawns &= wPawns - 1
-	}
-	bPawns := cb.Pawns[0]
-	for bPawns > 0 {
-		square = bits.TrailingZeros64(bPawns)
-		pawnsInFile[0][square%8] += 1
-		if uint64(1<<(square-8))&occupied != 0 {
-			eval += 50
-		}
-		bPawns &= bPawns - 1
-	}
-
-	// Doubled
-	for i := 0; i < 8; i++ {
-		if pawnsInFile[1][i] > 1 {
-			eval -= 50 * pawnsInFile[1][i]
-		}
-		if pawnsInFile[0][i] > 1 {
-			eval += 50 * pawnsInFile[0][i]
-		}
-	}
-
-	// Isolated
-	delta := [2]int{50, -50}
-	for i := range pawnsInFile {
-		for j := range pawnsInFile[i] {
-			if pawnsInFile[i][j] > 0 {
-				switch j {
-				case 0:
-					// If pawn(s) are in the A file and no friendly pawns are in the B file
-					if pawnsInFile[i][1] == 0 {
-						eval += delta[i]
-					}
-				case 7:
-					if pawnsInFile[i][6] == 0 {
-						eval += delta[i]
-					}
-				default:
-					if pawnsInFile[i][j-1] == 0 && pawnsInFile[i][j+1] == 0 {
-						eval += delta[i]
-					}
-				}
+	sign := [2]int{-1, 1} // first index is [black, white]
+
+	for color := range cb.Pawns {
+		pawns := cb.Pawns[color]
+
+		// Blocked
+		eval -= sign[color] * 50 * bits.OnesCount64(moves.BlockedPawns(pawns, occupied, uint(color)))
+
+		// Passed, scored by the number of ranks advanced
+		passed := moves.PassedPawns(pawns, cb.Pawns[1^color], uint(color))
+		for passed > 0 {
+			rank := bits.TrailingZeros64(passed) / 8
+			if color == 0 {
+				rank = 7 - rank
+			}
+			eval += sign[color] * passedPawnBonus[rank]
+			passed &= passed - 1
+		}
+
+		for file := 0; file < 8; file++ {
+			fileBB := moves.FILE_A << file
+			inFile := bits.OnesCount64(pawns & fileBB)
+			if inFile == 0 {
+				continue
+			}
+			// Doubled
+			if inFile > 1 {
+				eval -= sign[color] * 50 * inFile
+			}
+			// Isolated: no friendly pawns in the adjacent files
+			adjacentFiles := (fileBB & ^moves.FILE_A)>>1 | (fileBB & ^moves.FILE_H)<<1
+			if pawns&adjacentFiles == 0 {
+				eval -= sign[color] * 50
 			}
 		}
 	}
@@ -242,6 +775,9 @@ func evalPawns(cb *board.Board) int {
 	return eval
 }
 
+// Passed pawn bonus in centipawns, indexed by relative rank
+var passedPawnBonus = [8]int{0, 0, 10, 20, 35, 60, 100, 0}
+
 func evaluateMobility(cb *board.Board) int {
 	cb.WToMove ^= 1
 	oppMovesBB := pieces.GetAttackedSquares(cb)
@@ -251,12 +787,10 @@ func evaluateMobility(cb *board.Board) int {
 	origMovesBB := movesBB
 	// Include legal king moves and castling
 	movesBB |= pieces.GetKingMoves(cb.KingSqs[cb.WToMove], oppMovesBB, cb)
-	// Include pawn forward moves
-	pawnsBB := cb.Pawns[cb.WToMove]
-	for pawnsBB > 0 {
-		movesBB |= pieces.GetPawnMoves(int8(bits.TrailingZeros64(pawnsBB)), cb)
-		pawnsBB &= pawnsBB - 1
-	}
+	// Include pawn forward moves. Pawn captures are already in the attacked squares
+	empty := ^(cb.Pieces[0] | cb.Pieces[1])
+	movesBB |= moves.PawnSinglePushes(cb.Pawns[cb.WToMove], empty, cb.WToMove)
+	movesBB |= moves.PawnDoublePushes(cb.Pawns[cb.WToMove], empty, cb.WToMove)
 	movesBB &= ^cb.Pieces[cb.WToMove]
 	moveCount := bits.OnesCount64(movesBB)
 
@@ -264,11 +798,8 @@ func evaluateMobility(cb *board.Board) int {
 	// Include legal king moves and castling
 	oppMovesBB |= pieces.GetKingMoves(cb.KingSqs[cb.WToMove], origMovesBB, cb)
 	// Include pawn forward moves
-	oppPawnsBB := cb.Pawns[cb.WToMove]
-	for oppPawnsBB > 0 {
-		oppMovesBB |= pieces.GetPawnMoves(int8(bits.TrailingZeros64(oppPawnsBB)), cb)
-		oppPawnsBB &= oppPawnsBB - 1
-	}
+	oppMovesBB |= moves.PawnSinglePushes(cb.Pawns[cb.WToMove], empty, cb.WToMove)
+	oppMovesBB |= moves.PawnDoublePushes(cb.Pawns[cb.WToMove], empty, cb.WToMove)
 	oppMovesBB &= ^cb.Pieces[cb.WToMove]
 	oppMoveCount := bits.OnesCount64(oppMovesBB)
 	cb.WToMove ^= 1
@@ -302,61 +833,470 @@ type pvLine struct {
 	alreadyUsed []bool
 }
 
+// An engine instance with its own transposition table and settings, so that
+// several engines can search in one process
+type Engine struct {
+	tt      *TranspositionTable
+	threads int
+	// Time lost per move to communication with the GUI, in milliseconds
+	moveOverhead int
+	multiPV      int
+	// Move ordering tables of each search thread, kept between searches
+	orderings []*moveOrdering
+	// Centipawns by which the engine values a draw below an equal position
+	contempt int
+	// Score draws as DRAW regardless of contempt, to analyze both sides alike
+	analysisMode bool
+}
+
+func New() *Engine {
+	return &Engine{
+		tt:           NewTranspositionTable(DEFAULT_HASH_MB),
+		threads:      DEFAULT_THREADS,
+		moveOverhead: DEFAULT_MOVE_OVERHEAD,
+		multiPV:      DEFAULT_MULTI_PV,
+		contempt:     DEFAULT_CONTEMPT,
+	}
+}
+
+// Engine used by the package-level functions
+var defaultEngine = New()
+
+// Set the number of search threads, including the main thread
+func (e *Engine) SetThreads(n int) {
+	e.threads = max(1, min(n, MAX_THREADS))
+}
+
+func SetThreads(n int) {
+	defaultEngine.SetThreads(n)
+}
+
+// Set the number of best root moves to search and report
+func (e *Engine) SetMultiPV(n int) {
+	e.multiPV = max(1, min(n, MAX_MULTI_PV))
+}
+
+func SetMultiPV(n int) {
+	defaultEngine.SetMultiPV(n)
+}
+
+// Set how many centipawns the engine values a draw below an equal position.
+// A negative contempt makes the engine seek draws
+func (e *Engine) SetContempt(cp int) {
+	e.contempt = max(-MAX_CONTEMPT, min(cp, MAX_CONTEMPT))
+}
+
+func SetContempt(cp int) {
+	defaultEngine.SetContempt(cp)
+}
+
+// In analysis mode, draws are scored as DRAW for both sides
+func (e *Engine) SetAnalysisMode(on bool) {
+	e.analysisMode = on
+}
+
+func SetAnalysisMode(on bool) {
+	defaultEngine.SetAnalysisMode(on)
+}
+
+// A Lazy SMP search: every thread searches the same root position, and helper
+// threads speed up the main thread by filling the transposition table
+type search struct {
+	engine  *Engine
+	threads []*searchThread
+	stop    atomic.Bool
+	helpers sync.WaitGroup
+	// Root moves of the last iteration, best first
+	ranked []RankedMove
+	clock  searchTimer
+}
+
+func (e *Engine) newSearch(threads int) *search {
+	s := &search{engine: e}
+	for id := range threads {
+		if id == len(e.orderings) {
+			e.orderings = append(e.orderings, &moveOrdering{})
+		}
+		st := newSearchThread(id, e.tt, &s.stop)
+		st.ordering = e.orderings[id]
+		st.ordering.age()
+		if !e.analysisMode {
+			st.contempt = e.contempt
+		}
+		s.threads = append(s.threads, st)
+	}
+	return s
+}
+
+// Return the number of nodes searched by all threads
+func (s *search) nodes() uint64 {
+	nodes := uint64(0)
+	for _, st := range s.threads {
+		nodes += st.nodes.Load()
+	}
+	return nodes
+}
+
+// Limits of one search. A zero field means no limit
+type SearchLimits struct {
+	Depth int
+	Time  TimeControl
+	// Search exactly this many nodes, unless the search ends first
+	Nodes uint64
+	// Stop when a mate in this many moves is found
+	Mate int
+	// Ignore the time limits and search until stopped
+	Infinite bool
+	// If not nil, only search these root moves. Illegal moves are ignored, so
+	// with no legal move the search returns no move
+	SearchMoves []board.Move
+	// Zobrist hashes of the positions played before the root, oldest first,
+	// to detect repetitions
+	GameHistory []uint64
+	// If not nil, the search is pondering. It ignores the time limits until it
+	// receives a value from PonderHit, and does not return before ponderhit or
+	// stop
+	PonderHit chan bool
+}
+
+// Progress of a search, reported after each iteration
+type SearchInfo struct {
+	Depth int
+	// Highest ply reached, including quiescence search
+	SelDepth int
+	Eval     int
+	// Moves until mate, negative if the side to move is mated, 0 if no mate
+	Mate     int
+	PV       []board.Move
+	Hashfull int
+	// Rank of the PV among the root moves, starting at 1
+	MultiPV int
+	// Nodes of all threads
+	Nodes uint64
+	NPS   uint64
+	Time  time.Duration
+	Stats SearchStats
+}
+
+// A root move with its eval and principal variation
+type RankedMove struct {
+	Move board.Move
+	Eval int
+	PV   []board.Move
+}
+
+// Functions which receive the progress of a search. Nil functions are not called
+type SearchCallbacks struct {
+	Info func(SearchInfo)
+	// Called when the main thread starts a root move, at most once per
+	// PROGRESS_INTERVAL
+	Progress func(SearchProgress)
+}
+
+// Search one depth with the default engine on a single thread. origDepth and
+// origAge are ignored. parentPartialPV and completePV may be nil.
+//
+// Deprecated: use Search, which searches with all threads and iterative
+// deepening
+func Negamax(alpha, beta, depth int, cb *board.Board, origDepth int, origAge uint8, parentPartialPV *[]board.Move, completePV *pvLine) (int, board.Move) {
+	if parentPartialPV == nil {
+		parentPartialPV = &[]board.Move{}
+	}
+	if completePV == nil {
+		completePV = &pvLine{}
+	}
+	st := defaultEngine.newSearch(1).threads[0]
+	return st.negamax(alpha, beta, depth, cb, 0, parentPartialPV, completePV)
+}
+
 // Successively call negamax() with increasing depth. It is generally faster than
 // one search to a given depth
 func IterativeDeepening(cb *board.Board, depth int, stop ...chan bool) (int, board.Move) {
+	return Search(cb, SearchLimits{Depth: depth}, stop...)
+}
+
+// Search with the default engine, without reporting progress
+func Search(cb *board.Board, limits SearchLimits, stop ...chan bool) (int, board.Move) {
+	var stopChan chan bool
+	if len(stop) == 1 {
+		stopChan = stop[0]
+	}
+	return defaultEngine.Search(cb, limits, SearchCallbacks{}, stopChan)
+}
+
+// Search until a limit is reached or a value is received from stop, which may
+// be nil. Without a depth limit, the search stops at MAX_SEARCH_DEPTH. A node
+// limit is only exact for one thread, so node limited searches do not use
+// helper threads
+func (e *Engine) Search(cb *board.Board, limits SearchLimits, callbacks SearchCallbacks, stop chan bool) (int, board.Move) {
+	threads := e.threads
+	if limits.Nodes != 0 {
+		threads = 1
+	}
+	return e.newSearch(threads).iterativeDeepening(cb, limits, callbacks, stop)
+}
+
+// Search like Search, and return the best MultiPV root moves, best first
+func (e *Engine) SearchRanked(cb *board.Board, limits SearchLimits, callbacks SearchCallbacks, stop chan bool) []RankedMove {
+	threads := e.threads
+	if limits.Nodes != 0 {
+		threads = 1
+	}
+	s := e.newSearch(threads)
+	s.iterativeDeepening(cb, limits, callbacks, stop)
+	return s.ranked
+}
+
+func SearchRanked(cb *board.Board, limits SearchLimits) []RankedMove {
+	return defaultEngine.SearchRanked(cb, limits, SearchCallbacks{}, nil)
+}
+
+func (s *search) iterativeDeepening(cb *board.Board, limits SearchLimits, callbacks SearchCallbacks, stop chan bool) (int, board.Move) {
 	var eval int
 	var move board.Move
+	start := searchClock.Now()
+	overhead := time.Duration(s.engine.moveOverhead) * time.Millisecond
+	s.clock.soft, s.clock.hard, s.clock.timed = limits.Time.limits(cb.WToMove, overhead)
+	s.clock.timed = s.clock.timed && !limits.Infinite
+	if limits.PonderHit == nil {
+		s.clock.start(&s.stop)
+	}
+	defer s.clock.cancel()
+	// Tables indexed by depth or ply, like lmrReductions and the killers,
+	// hold MAX_SEARCH_DEPTH plies
+	depth := min(limits.Depth, MAX_SEARCH_DEPTH)
+	if depth == 0 {
+		depth = MAX_SEARCH_DEPTH
+	}
+	if limits.Mate > 0 {
+		// A mate in N moves is found within 2N-1 ply
+		depth = min(depth, 2*limits.Mate-1)
+	}
+	s.threads[0].nodeLimit = limits.Nodes
+	for _, st := range s.threads {
+		st.keys = slices.Clone(limits.GameHistory)
+		st.historyLen = len(limits.GameHistory)
+	}
+
+	rootMoves := pieces.GetLegalMoves(cb)
+	if limits.SearchMoves != nil {
+		// Without a legal move among them, nothing is searched
+		rootMoves = filterMoves(rootMoves, limits.SearchMoves)
+		for _, st := range s.threads {
+			st.searchMoves = rootMoves
+		}
+	}
+	// With MultiPV, line k is the best move after excluding lines 1 to k-1.
+	// Each line is ordered by its own PV from the previous iteration
+	multiPV := max(1, min(s.engine.multiPV, len(rootMoves)))
 	line := make([]board.Move, 0)
-	completePVLine := pvLine{}
-	completePVLine.alreadyUsed = make([]bool, depth)
+	completePVLines := make([]pvLine, multiPV)
+	for i := range completePVLines {
+		completePVLines[i].alreadyUsed = make([]bool, depth)
+	}
+	s.engine.tt.NewSearch()
 
-PlyLoop:
-	for ply := 1; ply <= depth; ply++ {
-		eval, move = negamax(-(1 << 30), 1<<30, ply, cb, ply, cb.HalfMoves, &line, &completePVLine)
-		completePVLine.moves = line
-		for i := range completePVLine.alreadyUsed {
-			completePVLine.alreadyUsed[i] = false
-		}
-
-		// UCI stdout. TODO: use ticker to reduce prints, if needed
-		// TODO: finish. add the important spec fields
-		fmt.Printf("info depth %d", ply)
-		if eval == MATE {
-			fmt.Printf(" score mate %d", len(completePVLine.moves))
-		} else if eval == -MATE {
-			fmt.Printf(" score mate -%d", len(completePVLine.moves))
-		} else {
-			fmt.Printf(" score cp %d", eval)
-		}
-		fmt.Printf(" hashfull %d", len(tTable)*1000/ORIG_HASH_CAP)
-		fmt.Printf(" pv")
-		algebraicMoves := convertMovesToLongAlgebraic(completePVLine.moves)
-		for _, algebraicMove := range algebraicMoves {
-			fmt.Printf(" %s", algebraicMove)
-		}
-		fmt.Println()
-
-		// UCI stop. TODO: stop inside the iterDeep recursion tree while keeping the PV moves
-		if len(stop) == 1 {
-			select {
-			case <-stop[0]:
-				break PlyLoop
-			default:
+	for _, helper := range s.threads[1:] {
+		s.helpers.Add(1)
+		go func(cb board.Board) {
+			defer s.helpers.Done()
+			helper.helperSearch(&cb, depth)
+		}(*cb)
+	}
+	mainThread := s.threads[0]
+	if callbacks.Progress != nil {
+		lastProgress := start
+		mainThread.onRootMove = func(depth int, move board.Move, number int) {
+			now := searchClock.Now()
+			if now.Sub(lastProgress) < PROGRESS_INTERVAL {
+				return
 			}
+			lastProgress = now
+			nodes := s.nodes()
+			callbacks.Progress(SearchProgress{
+				Depth:          depth,
+				CurrMove:       move,
+				CurrMoveNumber: number,
+				Nodes:          nodes,
+				NPS:            nodesPerSecond(nodes, now.Sub(start)),
+				Time:           now.Sub(start),
+				Hashfull:       s.engine.tt.Hashfull(),
+			})
 		}
 	}
-	bestmove := convertMovesToLongAlgebraic([]board.Move{move})[0]
-	fmt.Println("bestmove", bestmove)
 
-	cleanTranspositionTable(cb.HalfMoves)
+	// UCI stop aborts the search in the tree. Ponderhit starts the clock.
+	// An infinite search which runs out of depth still waits for stop
+	waitForStop := limits.Infinite && stop != nil
+	searchEnd := make(chan struct{})
+	if stop != nil || limits.PonderHit != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			ponderHit := limits.PonderHit
+			for {
+				select {
+				case <-stop:
+					s.stop.Store(true)
+					if ponderHit != nil || waitForStop {
+						close(searchEnd)
+					}
+					return
+				case <-ponderHit:
+					s.clock.start(&s.stop)
+					ponderHit = nil
+					if !waitForStop {
+						close(searchEnd)
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	for ply := 1; ply <= depth; ply++ {
+		plyRanked := make([]RankedMove, 0, multiPV)
+		mainThread.selDepth = 0
+		mainThread.excludedRootMoves = mainThread.excludedRootMoves[:0]
+		for i := range multiPV {
+			completePVLine := &completePVLines[i]
+			if len(completePVLine.moves) > 0 && slices.Contains(mainThread.excludedRootMoves, completePVLine.moves[0]) {
+				// The PV would lead into an excluded root move
+				completePVLine.moves = nil
+			}
+			prevEval, hasPrevEval := 0, false
+			if i < len(s.ranked) {
+				prevEval, hasPrevEval = s.ranked[i].Eval, true
+			}
+			plyEval, plyMove := mainThread.aspirationSearch(cb, ply, prevEval, hasPrevEval, &line, completePVLine)
+			if mainThread.aborted {
+				// The previous best move is searched first. Once any root move is
+				// completed, the partial result is at least as good as the last
+				// completed iteration. Otherwise, keep the last iteration's result
+				if mainThread.rootMove == emptyMove {
+					break
+				}
+				plyEval, plyMove = mainThread.rootEval, mainThread.rootMove
+			}
+			if plyMove == emptyMove {
+				break
+			}
+			plyRanked = append(plyRanked, RankedMove{Move: plyMove, Eval: plyEval, PV: slices.Clone(line)})
+			mainThread.excludedRootMoves = append(mainThread.excludedRootMoves, plyMove)
+			if mainThread.aborted {
+				break
+			}
+		}
+		if len(plyRanked) == 0 {
+			break
+		}
 
+		// A later line can score higher than an earlier one
+		slices.SortStableFunc(plyRanked, func(a, b RankedMove) int { return b.Eval - a.Eval })
+		for i, ranked := range plyRanked {
+			completePVLines[i].moves = slices.Clone(ranked.PV)
+			clear(completePVLines[i].alreadyUsed)
+		}
+		// Lines which an aborted iteration did not reach keep their previous result
+		for _, previous := range s.ranked {
+			if mainThread.aborted && len(plyRanked) < multiPV && !slices.ContainsFunc(plyRanked, func(r RankedMove) bool { return r.Move == previous.Move }) {
+				plyRanked = append(plyRanked, previous)
+			}
+		}
+		s.ranked = plyRanked
+		eval, move = s.ranked[0].Eval, s.ranked[0].Move
+
+		if callbacks.Info != nil {
+			elapsed := searchClock.Now().Sub(start)
+			nodes := s.nodes()
+			for i, ranked := range s.ranked {
+				callbacks.Info(SearchInfo{
+					Depth:    ply,
+					SelDepth: mainThread.selDepth,
+					Eval:     ranked.Eval,
+					Mate:     mateInMoves(ranked.Eval),
+					PV:       slices.Clone(ranked.PV),
+					Hashfull: s.engine.tt.Hashfull(),
+					MultiPV:  i + 1,
+					Nodes:    nodes,
+					NPS:      nodesPerSecond(nodes, elapsed),
+					Time:     elapsed,
+					Stats:    mainThread.stats,
+				})
+			}
+		}
+
+		if mainThread.aborted || s.stop.Load() {
+			break
+		}
+		if s.clock.softLimitReached() {
+			break
+		}
+		if mate := mateInMoves(eval); limits.Mate > 0 && mate > 0 && mate <= limits.Mate {
+			break
+		}
+	}
+	if limits.PonderHit != nil || waitForStop {
+		// The GUI expects no bestmove while pondering or in an infinite search
+		<-searchEnd
+	}
+	s.stop.Store(true)
+	s.helpers.Wait()
+
+	if move == emptyMove {
+		// Stopped before any root move was searched
+		if len(rootMoves) > 0 {
+			move = rootMoves[0]
+			s.ranked = []RankedMove{{Move: move, PV: []board.Move{move}}}
+		}
+	}
 	return eval, move
 }
 
+// Return the moves which are in both lists, in the order of legalMoves
+func filterMoves(legalMoves, moves []board.Move) []board.Move {
+	filtered := []board.Move{}
+	for _, move := range legalMoves {
+		if slices.Contains(moves, move) {
+			filtered = append(filtered, move)
+		}
+	}
+	return filtered
+}
+
+// Iteratively deepen until the main thread finishes. Odd-numbered helpers
+// start one ply deeper, so helpers do not all search the same depth at once
+func (st *searchThread) helperSearch(cb *board.Board, depth int) {
+	line := make([]board.Move, 0)
+	completePVLine := pvLine{}
+	completePVLine.alreadyUsed = make([]bool, depth)
+
+	for ply := 1 + st.id%2; ply <= depth; ply++ {
+		st.negamax(-INFINITY, INFINITY, ply, cb, 0, &line, &completePVLine)
+		if st.aborted {
+			return
+		}
+		completePVLine.moves = slices.Clone(line)
+		clear(completePVLine.alreadyUsed)
+	}
+}
+
 // Find an ideal, stable position with no critical captures or exchanges
-func quiesce(alpha, beta int, cb *board.Board) int {
+func (st *searchThread) quiesce(alpha, beta int, cb *board.Board, ply int) int {
+	if st.countNode() {
+		return 0
+	}
+	st.stats.QNodes++
+	st.selDepth = max(st.selDepth, ply)
+	// Captures may leave too little material to mate
+	if isInsufficientMaterial(cb) {
+		return st.drawScore(ply)
+	}
 	score := evaluate(cb)
+	if score == -MATE {
+		score += ply
+	}
 	if score >= beta {
 		return beta
 	} else if score > alpha {
@@ -399,9 +1339,12 @@ func quiesce(alpha, beta int, cb *board.Board) int {
 		pieces.MovePiece(capture, cb)
 
 		if capture.Piece == pieces.KING || cb.Kings[1^cb.WToMove]&pieces.GetAttackedSquares(cb) == 0 {
-			score = -quiesce(-beta, -alpha, cb)
+			score = -st.quiesce(-beta, -alpha, cb, ply+1)
 		}
 		board.RestorePosition(position, cb)
+		if st.aborted {
+			return 0
+		}
 
 		if score >= beta {
 			return beta
@@ -413,18 +1356,38 @@ func quiesce(alpha, beta int, cb *board.Board) int {
 	return alpha
 }
 
-// Remove cached nodes which were not just calculated
-func cleanTranspositionTable(currentHalfMoveAge uint8) {
-	if len(tTable) > ORIG_HASH_CAP/5*4 {
-		for key, stored := range tTable {
-			if stored.Age != currentHalfMoveAge {
-				delete(tTable, key)
-			}
-		}
+// Set the transposition table size in megabytes. Existing entries are discarded
+func (e *Engine) SetHashSize(mb int) {
+	e.tt.Resize(mb)
+}
+
+func SetHashSize(mb int) {
+	defaultEngine.SetHashSize(mb)
+}
+
+// Remove all transposition table entries
+func (e *Engine) ClearHash() {
+	e.tt.Clear()
+}
+
+func ClearHash() {
+	defaultEngine.ClearHash()
+}
+
+// Forget the previous game: clear the transposition table and the move
+// ordering tables
+func (e *Engine) NewGame() {
+	e.tt.Clear()
+	for _, ordering := range e.orderings {
+		ordering.clear()
 	}
 }
 
-func convertMovesToLongAlgebraic(moves []board.Move) []string {
+func NewGame() {
+	defaultEngine.NewGame()
+}
+
+func ConvertMovesToLongAlgebraic(moves []board.Move) []string {
 	algMoves := make([]string, len(moves))
 	chars := make([]byte, 0, 5)
 
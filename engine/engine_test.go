@@ -1,9 +1,13 @@
 package engine
 
 import (
+	"fmt"
 	"github.com/j1642/chess-engine-2/board"
 	"github.com/j1642/chess-engine-2/pieces"
+	"runtime"
+	"slices"
 	"testing"
+	"time"
 )
 
 type evalTestCase struct {
@@ -77,6 +81,11 @@ func TestEvalPawns(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	// Isolated a6 and b5 pawns are passed. The b5 pawn is further from promotion
+	cbPassed, err := board.FromFen("8/8/P7/1p6/8/8/8/8 w - - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	tests := []evalTestCase{
 		{
@@ -95,6 +104,10 @@ func TestEvalPawns(t *testing.T) {
 			cb:       cbBlocked,
 			expected: 50,
 		},
+		{
+			cb:       cbPassed,
+			expected: 60 - 20,
+		},
 	}
 
 	for i, tt := range tests {
@@ -110,6 +123,8 @@ type searchTestCase struct {
 	expectEval int
 	expectMove board.Move
 	depth      int
+	// Other moves which are as good as expectMove
+	alsoMoves []board.Move
 }
 
 func TestNegamax(t *testing.T) {
@@ -149,9 +164,11 @@ func TestNegamax(t *testing.T) {
 		{cb: bRookCapturesWRook, expectEval: 610, expectMove: board.Move{From: 0, To: 1, Piece: pieces.ROOK, PromoteTo: pieces.NO_PIECE}, depth: 1},
 		{cb: mateDepth0, expectEval: -MATE, expectMove: board.Move{From: 0, To: 0, Piece: 0, PromoteTo: 0}, depth: 0},
 		{cb: mateDepth1, expectEval: -MATE, expectMove: board.Move{From: 0, To: 0, Piece: 0, PromoteTo: 0}, depth: 1},
-		{cb: mateIn2Ply, expectEval: MATE, expectMove: board.Move{From: 10, To: 46, Piece: pieces.BISHOP, PromoteTo: pieces.NO_PIECE}, depth: 2},
-		{cb: mateIn3Ply, expectEval: -MATE, expectMove: board.Move{From: 55, To: 46, Piece: pieces.PAWN, PromoteTo: pieces.NO_PIECE}, depth: 3},
-		{cb: mateIn4Ply, expectEval: MATE, expectMove: board.Move{From: 37, To: 46, Piece: pieces.QUEEN, PromoteTo: pieces.NO_PIECE}, depth: 4},
+		{cb: mateIn2Ply, expectEval: MATE - 1, expectMove: board.Move{From: 10, To: 46, Piece: pieces.BISHOP, PromoteTo: pieces.NO_PIECE}, depth: 2},
+		{cb: mateIn3Ply, expectEval: -MATE + 2, expectMove: board.Move{From: 55, To: 46, Piece: pieces.PAWN, PromoteTo: pieces.NO_PIECE}, depth: 3},
+		// Qh5+ g6 Bxg6+ hxg6 Qxg6# also mates in as many moves, so move ordering picks one
+		{cb: mateIn4Ply, expectEval: MATE - 3, expectMove: board.Move{From: 37, To: 46, Piece: pieces.QUEEN, PromoteTo: pieces.NO_PIECE}, depth: 4,
+			alsoMoves: []board.Move{{From: 37, To: 39, Piece: pieces.QUEEN, PromoteTo: pieces.NO_PIECE}}},
 	}
 
 	for i, tt := range tests {
@@ -160,9 +177,9 @@ func TestNegamax(t *testing.T) {
 		completePVLine := pvLine{}
 		completePVLine.alreadyUsed = make([]bool, tt.depth)
 
-		eval, actualMove := negamax(-(1 << 30), 1<<30, tt.depth, tt.cb, tt.depth, tt.cb.HalfMoves, &line, &completePVLine)
+		eval, actualMove := defaultEngine.newSearch(1).threads[0].negamax(-(1 << 30), 1<<30, tt.depth, tt.cb, 0, &line, &completePVLine)
 
-		if actualMove != tt.expectMove {
+		if actualMove != tt.expectMove && !slices.Contains(tt.alsoMoves, actualMove) {
 			t.Errorf("negamax best move[%d]: want=%v, got=%v, eval=%d",
 				i, tt.expectMove, actualMove, eval)
 		}
@@ -172,6 +189,19 @@ func TestNegamax(t *testing.T) {
 	}
 }
 
+func TestDeprecatedNegamax(t *testing.T) {
+	NewGame()
+	cb, err := board.FromFen("6k1/8/6K1/8/8/8/8/R7 w - - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ra8 := board.Move{From: 0, To: 56, Piece: pieces.ROOK, PromoteTo: pieces.NO_PIECE}
+	eval, move := Negamax(-INFINITY, INFINITY, 2, cb, 2, 0, nil, nil)
+	if eval != MATE-1 || move != ra8 {
+		t.Errorf("want Ra8 with eval=%d, got %v with eval=%d", MATE-1, move, eval)
+	}
+}
+
 func TestIterativeDeepening(t *testing.T) {
 	kiwipete1, err := board.FromFen("r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1")
 	if err != nil {
@@ -192,7 +222,7 @@ func TestIterativeDeepening(t *testing.T) {
 	completePVLine := pvLine{}
 	completePVLine.alreadyUsed = make([]bool, depth)
 
-	eval2, move2 := negamax(-(1 << 30), 1<<30, depth, kiwipete2, depth, kiwipete2.HalfMoves, &line, &completePVLine)
+	eval2, move2 := defaultEngine.newSearch(1).threads[0].negamax(-(1 << 30), 1<<30, depth, kiwipete2, 0, &line, &completePVLine)
 
 	emptyMove := board.Move{}
 	if move1 == emptyMove {
@@ -206,12 +236,370 @@ func TestIterativeDeepening(t *testing.T) {
 	}
 }
 
+func TestLazySMP(t *testing.T) {
+	defer SetThreads(DEFAULT_THREADS)
+	for _, threads := range []int{1, 4} {
+		SetThreads(threads)
+		ClearHash()
+		// Bxf7 is mate
+		mateInOne, err := board.FromFen("rnbqkbnr/2ppp1pp/1p6/p4Q2/2B1P3/8/PPPP1PPP/RNB1K1NR w KQkq - 0 5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := defaultEngine.newSearch(defaultEngine.threads)
+		eval, move := s.iterativeDeepening(mateInOne, SearchLimits{Depth: 3}, SearchCallbacks{}, nil)
+		if eval != MATE-1 || move.From != 26 || move.To != 53 {
+			t.Errorf("threads=%d: want Bxf7 mate, got eval=%d move=%v", threads, eval, move)
+		}
+		if len(s.threads) != threads {
+			t.Errorf("thread count: want=%d, got=%d", threads, len(s.threads))
+		}
+		// Every helper has searched at least its first iteration
+		for _, st := range s.threads {
+			if st.nodes.Load() == 0 {
+				t.Errorf("threads=%d: thread %d searched no nodes", threads, st.id)
+			}
+		}
+	}
+}
+
+func TestSetThreads(t *testing.T) {
+	defer SetThreads(DEFAULT_THREADS)
+	for _, tt := range [][2]int{{0, 1}, {3, 3}, {MAX_THREADS + 1, MAX_THREADS}} {
+		SetThreads(tt[0])
+		if defaultEngine.threads != tt[1] {
+			t.Errorf("SetThreads(%d): want=%d, got=%d", tt[0], tt[1], defaultEngine.threads)
+		}
+	}
+}
+
+// Time to depth is ns/op. Thread counts double up to the number of CPUs,
+// which is always included
+func BenchmarkLazySMP(b *testing.B) {
+	defer SetThreads(DEFAULT_THREADS)
+	cpus := min(runtime.NumCPU(), MAX_THREADS)
+	threadCounts := []int{}
+	for threads := 1; threads < cpus; threads *= 2 {
+		threadCounts = append(threadCounts, threads)
+	}
+	threadCounts = append(threadCounts, cpus)
+	for _, threads := range threadCounts {
+		b.Run(fmt.Sprintf("threads=%d", threads), func(b *testing.B) {
+			nodes := uint64(0)
+			for range b.N {
+				NewGame()
+				cb, err := board.FromFen("r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R w KQkq - 2 3")
+				if err != nil {
+					b.Fatal(err)
+				}
+				s := defaultEngine.newSearch(threads)
+				s.iterativeDeepening(cb, SearchLimits{Depth: 6}, SearchCallbacks{}, nil)
+				nodes += s.nodes()
+			}
+			b.ReportMetric(float64(nodes)/b.Elapsed().Seconds(), "nodes/s")
+		})
+	}
+}
+
+func TestNodeLimit(t *testing.T) {
+	ClearHash()
+	cb, err := board.FromFen("r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R w KQkq - 2 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := defaultEngine.newSearch(1)
+	_, move := s.iterativeDeepening(cb, SearchLimits{Nodes: 5000}, SearchCallbacks{}, nil)
+	if s.nodes() != 5000 {
+		t.Errorf("nodes: want=5000, got=%d", s.nodes())
+	}
+	if move == emptyMove {
+		t.Error("node limited search returned an empty move")
+	}
+	// The board is restored after the search is cut off
+	expected, _ := board.FromFen("r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R w KQkq - 2 3")
+	if *cb != *expected {
+		t.Error("board changed after node limited search")
+	}
+}
+
+func TestDepthLimitAboveMaxSearchDepth(t *testing.T) {
+	cb, err := board.FromFen("k7/8/1K6/8/8/8/8/7R b - - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	depth := 0
+	callbacks := SearchCallbacks{Info: func(info SearchInfo) { depth = info.Depth }}
+	New().Search(cb, SearchLimits{Depth: MAX_SEARCH_DEPTH + 6}, callbacks, nil)
+	if depth != MAX_SEARCH_DEPTH {
+		t.Errorf("want the search clamped to depth %d, got %d", MAX_SEARCH_DEPTH, depth)
+	}
+}
+
+func TestMateLimit(t *testing.T) {
+	mateInTwo, err := board.FromFen("k7/8/2K5/8/8/8/8/7R w - - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	NewGame()
+	eval, move := defaultEngine.newSearch(1).iterativeDeepening(mateInTwo, SearchLimits{Mate: 2}, SearchCallbacks{}, nil)
+	if eval != MATE-3 || move == emptyMove {
+		t.Errorf("mate in 2: want eval=%d, got eval=%d move=%v", MATE-3, eval, move)
+	}
+
+	// Without a mate in 1, the search ends after 1 ply
+	NewGame()
+	mateLimited := defaultEngine.newSearch(1)
+	eval, _ = mateLimited.iterativeDeepening(mateInTwo, SearchLimits{Mate: 1}, SearchCallbacks{}, nil)
+	NewGame()
+	depthLimited := defaultEngine.newSearch(1)
+	depthLimited.iterativeDeepening(mateInTwo, SearchLimits{Depth: 1}, SearchCallbacks{}, nil)
+	if mateInMoves(eval) != 0 || mateLimited.nodes() != depthLimited.nodes() {
+		t.Errorf("mate in 1: want a 1 ply search of %d nodes, got eval=%d nodes=%d",
+			depthLimited.nodes(), eval, mateLimited.nodes())
+	}
+}
+
+func TestInfiniteLimit(t *testing.T) {
+	c := useFakeClock(t, time.Hour)
+	cb, err := board.FromFen("r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R w KQkq - 2 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan bool, 1)
+	stop <- true
+	// Time limits are ignored, and the search runs until stopped
+	_, move := Search(cb, SearchLimits{Infinite: true, Time: TimeControl{MoveTime: 1}}, stop)
+	if move == emptyMove {
+		t.Error("infinite search returned an empty move")
+	}
+	if c.timerCount() != 0 {
+		t.Error("infinite search set a hard time limit")
+	}
+}
+
+func TestStopAbortsSearch(t *testing.T) {
+	cb, err := board.FromFen("r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan bool)
+	done := make(chan board.Move)
+	go func() {
+		_, move := Search(cb, SearchLimits{Infinite: true}, stop)
+		done <- move
+	}()
+	time.Sleep(100 * time.Millisecond)
+	stop <- true
+
+	select {
+	case move := <-done:
+		if move == emptyMove {
+			t.Error("stopped search returned an empty move")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("search did not stop inside the tree")
+	}
+}
+
+func TestAbortedIterationResult(t *testing.T) {
+	fen := "r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R w KQkq - 2 3"
+	cb, err := board.FromFen(fen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	NewGame()
+	s := defaultEngine.newSearch(1)
+	depth1Eval, depth1Move := s.iterativeDeepening(cb, SearchLimits{Depth: 1}, SearchCallbacks{}, nil)
+
+	// Aborted before a root move of the second iteration is completed, so
+	// the first iteration's result is kept
+	NewGame()
+	eval, move := defaultEngine.newSearch(1).iterativeDeepening(cb, SearchLimits{Nodes: s.nodes() + 1}, SearchCallbacks{}, nil)
+	if eval != depth1Eval || move != depth1Move {
+		t.Errorf("want the depth 1 result (%d, %v), got (%d, %v)", depth1Eval, depth1Move, eval, move)
+	}
+
+	// Aborted at the end of the second iteration, after the best root move
+	NewGame()
+	s = defaultEngine.newSearch(1)
+	depth2Eval, depth2Move := s.iterativeDeepening(cb, SearchLimits{Depth: 2}, SearchCallbacks{}, nil)
+	NewGame()
+	eval, move = defaultEngine.newSearch(1).iterativeDeepening(cb, SearchLimits{Nodes: s.nodes() - 1}, SearchCallbacks{}, nil)
+	if eval != depth2Eval || move != depth2Move {
+		t.Errorf("want the partial depth 2 result (%d, %v), got (%d, %v)", depth2Eval, depth2Move, eval, move)
+	}
+
+	// Aborted before any iteration is completed, so a legal move is returned
+	_, move = defaultEngine.newSearch(1).iterativeDeepening(cb, SearchLimits{Nodes: 1}, SearchCallbacks{}, nil)
+	legalMove := false
+	for _, legal := range pieces.GetLegalMoves(cb) {
+		legalMove = legalMove || legal == move
+	}
+	if !legalMove {
+		t.Errorf("want a legal move, got %v", move)
+	}
+}
+
+func TestUpdatePV(t *testing.T) {
+	a, b, c := board.Move{From: 12, To: 28}, board.Move{From: 52, To: 36}, board.Move{From: 6, To: 21}
+	pv := []board.Move{a, b, c}
+	// A shorter PV replaces the whole line
+	updatePV(&pv, c, []board.Move{a})
+	if !slices.Equal(pv, []board.Move{c, a}) {
+		t.Errorf("want=%v, got=%v", []board.Move{c, a}, pv)
+	}
+	updatePV(&pv, b, nil)
+	if !slices.Equal(pv, []board.Move{b}) {
+		t.Errorf("want=%v, got=%v", []board.Move{b}, pv)
+	}
+}
+
+func TestSearchCallbacks(t *testing.T) {
+	cb, err := board.FromFen("r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R w KQkq - 2 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos := []SearchInfo{}
+	callbacks := SearchCallbacks{Info: func(info SearchInfo) { infos = append(infos, info) }}
+	eval, move := New().Search(cb, SearchLimits{Depth: 3}, callbacks, nil)
+
+	if len(infos) != 3 {
+		t.Fatalf("info count: want=3, got=%d", len(infos))
+	}
+	for i, info := range infos {
+		if info.Depth != i+1 || len(info.PV) == 0 {
+			t.Errorf("info[%d]: want depth=%d and a PV, got %v", i, i+1, info)
+		}
+	}
+	last := infos[len(infos)-1]
+	if last.Eval != eval || last.PV[0] != move {
+		t.Errorf("last info: want eval=%d pv[0]=%v, got %v", eval, move, last)
+	}
+}
+
+func TestMultiPV(t *testing.T) {
+	cb, err := board.FromFen("r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R w KQkq - 2 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := New()
+	e.SetMultiPV(3)
+	infos := []SearchInfo{}
+	callbacks := SearchCallbacks{Info: func(info SearchInfo) { infos = append(infos, info) }}
+	ranked := e.SearchRanked(cb, SearchLimits{Depth: 3}, callbacks, nil)
+
+	if len(ranked) != 3 {
+		t.Fatalf("ranked moves: want=3, got=%d", len(ranked))
+	}
+	for i, r := range ranked {
+		if len(r.PV) == 0 || r.PV[0] != r.Move {
+			t.Errorf("ranked[%d]: PV does not start with the move, got %v", i, r)
+		}
+		if i > 0 && (r.Eval > ranked[i-1].Eval || r.Move == ranked[i-1].Move) {
+			t.Errorf("ranked[%d]: want a different move with eval <= %d, got %v", i, ranked[i-1].Eval, r)
+		}
+	}
+	if ranked[0].Move == ranked[2].Move {
+		t.Errorf("the first and third moves are the same: %v", ranked[0].Move)
+	}
+
+	// Each depth reports every line in rank order
+	if len(infos) != 9 {
+		t.Fatalf("info count: want=9, got=%d", len(infos))
+	}
+	for i, info := range infos {
+		if info.Depth != i/3+1 || info.MultiPV != i%3+1 {
+			t.Errorf("info[%d]: want depth=%d multipv=%d, got %v", i, i/3+1, i%3+1, info)
+		}
+	}
+	for i, info := range infos[6:] {
+		if info.Eval != ranked[i].Eval || info.PV[0] != ranked[i].Move {
+			t.Errorf("last info for multipv %d: want %v, got %v", i+1, ranked[i], info)
+		}
+	}
+
+	// There are no more lines than legal moves
+	e.SetMultiPV(10)
+	cb, err = board.FromFen("7k/8/8/8/8/8/6PP/7K w - - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ranked := e.SearchRanked(cb, SearchLimits{Depth: 2}, SearchCallbacks{}, nil); len(ranked) != 5 {
+		t.Errorf("ranked moves with 5 legal moves: want=5, got=%d", len(ranked))
+	}
+}
+
+func TestSearchMoves(t *testing.T) {
+	a2a3 := board.Move{From: 8, To: 16, Piece: pieces.PAWN, PromoteTo: pieces.NO_PIECE}
+	h2h4 := board.Move{From: 15, To: 31, Piece: pieces.PAWN, PromoteTo: pieces.NO_PIECE}
+	illegal := board.Move{From: 12, To: 36, Piece: pieces.PAWN, PromoteTo: pieces.NO_PIECE}
+	e := New()
+	// An earlier search fills the transposition table with other root moves
+	e.Search(board.New(), SearchLimits{Depth: 3}, SearchCallbacks{}, nil)
+
+	e.SetMultiPV(3)
+	infos := []SearchInfo{}
+	callbacks := SearchCallbacks{Info: func(info SearchInfo) { infos = append(infos, info) }}
+	limits := SearchLimits{Depth: 3, SearchMoves: []board.Move{a2a3, h2h4, illegal}}
+	ranked := e.SearchRanked(board.New(), limits, callbacks, nil)
+	if len(ranked) != 2 {
+		t.Fatalf("ranked moves: want=2, got=%v", ranked)
+	}
+	for _, r := range ranked {
+		if r.Move != a2a3 && r.Move != h2h4 {
+			t.Errorf("searched a root move outside searchmoves: %v", r.Move)
+		}
+	}
+	for _, info := range infos {
+		if info.PV[0] != a2a3 && info.PV[0] != h2h4 {
+			t.Errorf("reported a PV outside searchmoves: %v", info.PV)
+		}
+	}
+
+	// Without legal moves to search, the search does not widen to all moves
+	e.SetMultiPV(1)
+	_, move := e.Search(board.New(), SearchLimits{Depth: 2, SearchMoves: []board.Move{illegal}}, SearchCallbacks{}, nil)
+	if move != emptyMove {
+		t.Errorf("want no move, got %v", move)
+	}
+	if ranked := e.SearchRanked(board.New(), SearchLimits{Depth: 2, SearchMoves: []board.Move{}}, SearchCallbacks{}, nil); len(ranked) != 0 {
+		t.Errorf("empty searchmoves: want no ranked moves, got %v", ranked)
+	}
+}
+
+func TestEnginesAreIndependent(t *testing.T) {
+	e1, e2 := New(), New()
+	e1.SetThreads(2)
+	if e2.threads != DEFAULT_THREADS {
+		t.Errorf("threads: want=%d, got=%d", DEFAULT_THREADS, e2.threads)
+	}
+	cb := board.New()
+	e1.Search(cb, SearchLimits{Depth: 3}, SearchCallbacks{}, nil)
+
+	// Positions after the root moves are stored in e1's table only
+	stored1, stored2 := 0, 0
+	for _, move := range pieces.GetLegalMoves(cb) {
+		pos := board.StorePosition(cb)
+		pieces.MovePiece(move, cb)
+		if _, ok := e1.tt.Probe(cb.Zobrist); ok {
+			stored1++
+		}
+		if _, ok := e2.tt.Probe(cb.Zobrist); ok {
+			stored2++
+		}
+		board.RestorePosition(pos, cb)
+	}
+	if stored1 == 0 || stored2 != 0 {
+		t.Errorf("stored root children: want e1 > 0 and e2 = 0, got %d and %d", stored1, stored2)
+	}
+}
+
 func TestQuiesce(t *testing.T) {
 	rooksKings, err := board.FromFen("r3k2r/8/8/8/8/8/8/R3K2R w KQkq - 0 1")
 	if err != nil {
 		t.Error(err)
 	}
-	eval := quiesce(-(1 << 30), 1<<30, rooksKings)
+	eval := defaultEngine.newSearch(1).threads[0].quiesce(-(1 << 30), 1<<30, rooksKings, 0)
 	expected := 727
 	if eval != expected {
 		t.Errorf("want=%d, got=%d", expected, eval)
@@ -224,7 +612,7 @@ func TestConvertMovesToLongAlgebraic(t *testing.T) {
 		t.Error(err)
 	}
 	boardMoves := pieces.GetAllMoves(cb)
-	actual := convertMovesToLongAlgebraic(boardMoves)
+	actual := ConvertMovesToLongAlgebraic(boardMoves)
 	expected := []string{"b7b8q", "b7b8r", "b7b8n", "b7b8b", "a8b6", "a8c7"}
 	for i, actualAlgMove := range actual {
 		if expected[i] != actualAlgMove {
@@ -300,3 +688,580 @@ func TestEngineDetectsMateInOne(t *testing.T) {
 	}
 }
 */
+
+// Positions for comparing the node counts of search features at equal depth
+var featurePositions = []string{
+	"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1",
+	"r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R w KQkq - 2 3",
+	"8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1",
+}
+
+// Return the nodes searched in featurePositions to depth with the given features
+func countFeatureNodes(t *testing.T, f searchFeatures, depth int) uint64 {
+	defer func(saved searchFeatures) { features = saved }(features)
+	features = f
+	total := uint64(0)
+	for _, fen := range featurePositions {
+		cb, err := board.FromFen(fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := New().newSearch(1)
+		s.iterativeDeepening(cb, SearchLimits{Depth: depth}, SearchCallbacks{}, nil)
+		total += s.nodes()
+	}
+	return total
+}
+
+func TestPVSAndAspirationReduceNodes(t *testing.T) {
+	depth := 4
+	baseline := countFeatureNodes(t, searchFeatures{}, depth)
+	pvs := countFeatureNodes(t, searchFeatures{pvs: true}, depth)
+	both := countFeatureNodes(t, searchFeatures{pvs: true, aspiration: true}, depth)
+	t.Logf("nodes at depth %d: full windows=%d, PVS=%d (%.0f%% fewer), PVS and aspiration=%d (%.0f%% fewer)",
+		depth, baseline, pvs, 100-100*float64(pvs)/float64(baseline), both, 100-100*float64(both)/float64(baseline))
+	if pvs >= baseline || both >= baseline {
+		t.Errorf("want fewer nodes than %d with full windows, got PVS=%d, both=%d", baseline, pvs, both)
+	}
+}
+
+// Return a search thread whose search path holds ply unrelated positions, for
+// tests which enter the search below the root
+func newThreadAtPly(ply int) *searchThread {
+	st := New().newSearch(1).threads[0]
+	st.keys = make([]uint64, ply)
+	return st
+}
+
+func TestNullMoveCutoff(t *testing.T) {
+	tests := []struct {
+		name, fen string
+		depth     int
+		want      bool
+	}{
+		// White is a queen ahead, so passing still fails high
+		{"queen ahead", "4k3/8/8/8/8/8/8/Q3K3 w - - 0 1", NULL_MOVE_MIN_DEPTH, true},
+		{"verified", "4k3/8/8/8/8/8/8/Q3K3 w - - 0 1", NULL_MOVE_VERIFY_DEPTH, true},
+		{"too shallow", "4k3/8/8/8/8/8/8/Q3K3 w - - 0 1", NULL_MOVE_MIN_DEPTH - 1, false},
+		{"in check", "4k3/8/8/8/8/8/8/Q3K2r w - - 0 1", NULL_MOVE_MIN_DEPTH, false},
+		// King and pawn endings are often zugzwang
+		{"only pawns", "4k3/8/8/8/8/8/PPPP4/4K3 w - - 0 1", NULL_MOVE_MIN_DEPTH, false},
+	}
+	for _, tt := range tests {
+		cb, err := board.FromFen(tt.fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zobrist := cb.Zobrist
+		st := newThreadAtPly(1)
+		// The node has stored its own key before trying the null move
+		st.keys = append(st.keys, cb.Zobrist)
+		got := st.nullMoveCutoff(-500, tt.depth, cb, 1)
+		if got != tt.want {
+			t.Errorf("%s: want=%v, got=%v", tt.name, tt.want, got)
+		}
+		if cb.Zobrist != zobrist || st.noNullMove {
+			t.Errorf("%s: board or null-move flag not restored", tt.name)
+		}
+	}
+}
+
+func TestNullMoveVerificationRejectsZugzwang(t *testing.T) {
+	// After 1. Kh6, every Black move loses material, but passing is safe
+	cb, err := board.FromFen("1q1k4/2Rr4/7K/2Q5/8/8/8/8 b - - 1 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	beta, depth := -240, NULL_MOVE_VERIFY_DEPTH
+	line := make([]board.Move, 0)
+
+	// The null-move search alone fails high
+	st := newThreadAtPly(2)
+	undo := cb.MakeNullMove()
+	st.noNullMove = true
+	score, _ := st.negamax(-beta, -beta+1, depth-1-NULL_MOVE_REDUCTION, cb, 2, &line, &pvLine{})
+	cb.UnmakeNullMove(undo)
+	if -score < beta {
+		t.Fatalf("null-move search: want a fail high, got %d", -score)
+	}
+	// Searching the moves fails low
+	st = newThreadAtPly(1)
+	st.noNullMove = true
+	if score, _ := st.negamax(beta-1, beta, depth, cb, 1, &line, &pvLine{}); score >= beta {
+		t.Fatalf("search: want a fail low, got %d", score)
+	}
+	st = newThreadAtPly(1)
+	st.keys = append(st.keys, cb.Zobrist)
+	if st.nullMoveCutoff(beta, depth, cb, 1) {
+		t.Error("verification: want the null-move cutoff rejected")
+	}
+}
+
+func TestNullMovePruningReducesNodes(t *testing.T) {
+	depth := 5
+	without := countFeatureNodes(t, searchFeatures{pvs: true, aspiration: true}, depth)
+	with := countFeatureNodes(t, searchFeatures{pvs: true, aspiration: true, nullMove: true}, depth)
+	t.Logf("nodes at depth %d: without null moves=%d, with=%d (%.0f%% fewer)",
+		depth, without, with, 100-100*float64(with)/float64(without))
+	if with >= without {
+		t.Errorf("want fewer nodes than %d without null-move pruning, got %d", without, with)
+	}
+}
+
+// Return the deepest complete iteration in featurePositions within nodes,
+// summed over the positions
+func featureDepthReached(t *testing.T, f searchFeatures, nodes uint64) int {
+	defer func(saved searchFeatures) { features = saved }(features)
+	features = f
+	total := 0
+	for _, fen := range featurePositions {
+		cb, err := board.FromFen(fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		depth := 0
+		callbacks := SearchCallbacks{Info: func(info SearchInfo) { depth = info.Depth }}
+		New().newSearch(1).iterativeDeepening(cb, SearchLimits{Nodes: nodes}, callbacks, nil)
+		total += depth
+	}
+	return total
+}
+
+func TestLateMoveReductionsAndPruningReduceNodes(t *testing.T) {
+	depth := 5
+	before := searchFeatures{pvs: true, aspiration: true, nullMove: true}
+	after := searchFeatures{pvs: true, aspiration: true, nullMove: true, lmr: true, lmp: true}
+	withoutNodes := countFeatureNodes(t, before, depth)
+	lmrNodes := countFeatureNodes(t, searchFeatures{pvs: true, aspiration: true, nullMove: true, lmr: true}, depth)
+	withNodes := countFeatureNodes(t, after, depth)
+	t.Logf("nodes at depth %d: without=%d, LMR=%d, LMR and LMP=%d (%.0f%% fewer)",
+		depth, withoutNodes, lmrNodes, withNodes, 100-100*float64(withNodes)/float64(withoutNodes))
+	if lmrNodes >= withoutNodes || withNodes >= withoutNodes {
+		t.Errorf("want fewer nodes than %d, got LMR=%d, LMR and LMP=%d", withoutNodes, lmrNodes, withNodes)
+	}
+
+	nodes := uint64(200_000)
+	withoutDepth := featureDepthReached(t, before, nodes)
+	withDepth := featureDepthReached(t, after, nodes)
+	t.Logf("total depth in %d nodes per position: without=%d, with=%d", nodes, withoutDepth, withDepth)
+	if withDepth < withoutDepth {
+		t.Errorf("want at least depth %d, got %d", withoutDepth, withDepth)
+	}
+}
+
+func TestLMRReductions(t *testing.T) {
+	if lmrReductions[1][63] != 0 || lmrReductions[LMR_MIN_DEPTH][1] != 0 {
+		t.Error("want no reduction at depth 1 or for the first move")
+	}
+	for depth := 2; depth <= MAX_SEARCH_DEPTH; depth++ {
+		for moveNum := 2; moveNum < 64; moveNum++ {
+			r := lmrReductions[depth][moveNum]
+			if r < lmrReductions[depth-1][moveNum] || r < lmrReductions[depth][moveNum-1] {
+				t.Fatalf("reduction at depth %d, move %d decreases", depth, moveNum)
+			}
+		}
+	}
+}
+
+func TestIsQuiet(t *testing.T) {
+	cb, err := board.FromFen("4k3/1P6/8/3pP3/8/8/8/R3K2n w - d6 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		move board.Move
+		want bool
+	}{
+		{board.Move{From: 0, To: 8, Piece: pieces.ROOK, PromoteTo: pieces.NO_PIECE}, true},
+		{board.Move{From: 4, To: 7, Piece: pieces.KING, PromoteTo: pieces.NO_PIECE}, false},
+		{board.Move{From: 36, To: 43, Piece: pieces.PAWN, PromoteTo: pieces.NO_PIECE}, false},
+		{board.Move{From: 49, To: 57, Piece: pieces.PAWN, PromoteTo: pieces.QUEEN}, false},
+		{board.Move{From: 36, To: 44, Piece: pieces.PAWN, PromoteTo: pieces.NO_PIECE}, true},
+	}
+	for _, tt := range tests {
+		if got := isQuiet(tt.move, cb); got != tt.want {
+			t.Errorf("isQuiet(%v): want=%v, got=%v", tt.move, tt.want, got)
+		}
+	}
+}
+
+func TestExtensionsFindMates(t *testing.T) {
+	tests := []struct {
+		fen   string
+		depth int
+		move  board.Move
+	}{
+		// Philidor's legacy: Nh6+ Kh8 Qg8+ Rxg8 Nf7#
+		{"r5k1/5Npp/8/8/8/1Q6/8/6K1 w - - 0 1", 3, board.Move{From: 53, To: 47, Piece: pieces.KNIGHT, PromoteTo: pieces.NO_PIECE}},
+		{"2r3k1/p4p2/3Rp2p/1p2P1pK/8/1P4P1/P3Q2P/1q6 b - - 0 1", 2, board.Move{From: 1, To: 46, Piece: pieces.QUEEN, PromoteTo: pieces.NO_PIECE}},
+		{"r1b1kb1r/pppp1ppp/5q2/4n3/3KP3/2N3PN/PPP4P/R1BQ1B1R b kq - 0 1", 3, board.Move{From: 61, To: 34, Piece: pieces.BISHOP, PromoteTo: pieces.NO_PIECE}},
+		{"1k5r/pP3ppp/3p2b1/1BN1n3/1Q2P3/P1B5/KP3P1P/7q w - - 1 0", 3, board.Move{From: 34, To: 40, Piece: pieces.KNIGHT, PromoteTo: pieces.NO_PIECE}},
+		{"3r4/pR2N3/2pkb3/5p2/8/2B5/qP3PPP/4R1K1 w - - 1 0", 3, board.Move{From: 18, To: 36, Piece: pieces.BISHOP, PromoteTo: pieces.NO_PIECE}},
+	}
+	for _, tt := range tests {
+		cb, err := board.FromFen(tt.fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Each mate is 5 plies long, beyond the nominal depth
+		mate := 0
+		callbacks := SearchCallbacks{Info: func(info SearchInfo) { mate = info.Mate }}
+		_, move := New().Search(cb, SearchLimits{Depth: tt.depth}, callbacks, nil)
+		if mate != 3 || move != tt.move {
+			t.Errorf("%q: want mate in 3 with %v, got mate in %d with %v", tt.fen, tt.move, mate, move)
+		}
+	}
+}
+
+func TestCanExtend(t *testing.T) {
+	st := New().newSearch(1).threads[0]
+	st.rootDepth = 4
+	if !st.canExtend(2, 2) {
+		t.Error("want an unextended line to be extendable")
+	}
+	if st.canExtend(2+MAX_EXTENSIONS, 2) {
+		t.Errorf("want at most %d extensions per line", MAX_EXTENSIONS)
+	}
+	st.rootDepth = MAX_SEARCH_DEPTH
+	if st.canExtend(MAX_SEARCH_DEPTH-1, 1) {
+		t.Errorf("want no extensions beyond ply %d", MAX_SEARCH_DEPTH)
+	}
+}
+
+func TestIsPassedPawnPush(t *testing.T) {
+	tests := []struct {
+		fen  string
+		move board.Move
+		want bool
+	}{
+		{"4k3/8/4P3/8/8/8/8/4K3 w - - 0 1", board.Move{From: 44, To: 52, Piece: pieces.PAWN, PromoteTo: pieces.NO_PIECE}, true},
+		{"4k3/8/8/8/8/3p4/8/4K3 b - - 0 1", board.Move{From: 19, To: 11, Piece: pieces.PAWN, PromoteTo: pieces.NO_PIECE}, true},
+		// A capture onto the seventh rank also passes the pawn
+		{"4k3/5p2/4P3/8/8/8/8/4K3 w - - 0 1", board.Move{From: 44, To: 53, Piece: pieces.PAWN, PromoteTo: pieces.NO_PIECE}, true},
+		// Not the seventh rank
+		{"4k3/8/8/4P3/8/8/8/4K3 w - - 0 1", board.Move{From: 36, To: 44, Piece: pieces.PAWN, PromoteTo: pieces.NO_PIECE}, false},
+	}
+	for _, tt := range tests {
+		cb, err := board.FromFen(tt.fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := isPassedPawnPush(tt.move, cb); got != tt.want {
+			t.Errorf("%q: want=%v, got=%v", tt.fen, tt.want, got)
+		}
+	}
+}
+
+func TestFutilityPruningReducesNodes(t *testing.T) {
+	depth := 5
+	without := features
+	without.futility = false
+	withoutNodes := countFeatureNodes(t, without, depth)
+	withNodes := countFeatureNodes(t, features, depth)
+	t.Logf("nodes at depth %d: without futility pruning and razoring=%d, with=%d (%.0f%% fewer)",
+		depth, withoutNodes, withNodes, 100-100*float64(withNodes)/float64(withoutNodes))
+	if withNodes >= withoutNodes {
+		t.Errorf("want fewer nodes than %d, got %d", withoutNodes, withNodes)
+	}
+}
+
+func TestReverseFutilityPruning(t *testing.T) {
+	tests := []struct {
+		name, fen string
+		alpha     int
+		beta      int
+		pruned    bool
+	}{
+		// White is a queen ahead, far above beta
+		{"pruned", "4k3/8/8/8/8/8/3PPP2/Q3K3 w - - 0 1", -1, 0, true},
+		{"pv node", "4k3/8/8/8/8/8/3PPP2/Q3K3 w - - 0 1", -100, 0, false},
+		{"in check", "4k3/8/8/8/8/8/3P1P2/Q3K2r w - - 0 1", -1, 0, false},
+		{"near mate", "4k3/8/8/8/8/8/3PPP2/Q3K3 w - - 0 1", -MATE + 4, -MATE + 5, false},
+	}
+	for _, tt := range tests {
+		cb, err := board.FromFen(tt.fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := newThreadAtPly(1)
+		st.noNullMove = true
+		line := make([]board.Move, 0)
+		st.negamax(tt.alpha, tt.beta, 1, cb, 1, &line, &pvLine{})
+		// A pruned node returns before searching any move
+		if pruned := st.nodes.Load() == 1; pruned != tt.pruned {
+			t.Errorf("%s: want pruned=%v, got %v", tt.name, tt.pruned, pruned)
+		}
+	}
+}
+
+func TestRazoring(t *testing.T) {
+	tests := []struct {
+		name        string
+		depth       int
+		alpha, beta int
+		razored     bool
+	}{
+		// White is a queen behind, far below alpha
+		{"depth 1", 1, 0, 1, true},
+		{"depth 3", FUTILITY_MAX_DEPTH, 0, 1, true},
+		{"pv node", FUTILITY_MAX_DEPTH, 0, 100, false},
+		{"too deep", FUTILITY_MAX_DEPTH + 1, 0, 1, false},
+	}
+	for _, tt := range tests {
+		cb, err := board.FromFen("q3k3/8/8/8/8/8/8/4K3 w - - 0 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := newThreadAtPly(1)
+		st.noNullMove = true
+		line := make([]board.Move, 0)
+		st.negamax(tt.alpha, tt.beta, tt.depth, cb, 1, &line, &pvLine{})
+		// A razored node only runs quiescence, so it is the sole search node
+		if razored := st.stats.SearchNodes == 1; razored != tt.razored {
+			t.Errorf("%s: want razored=%v, got %v", tt.name, tt.razored, razored)
+		}
+	}
+}
+
+func TestIsMateScore(t *testing.T) {
+	for _, score := range []int{MATE, -MATE, MATE - 3, -MATE + 3, INFINITY} {
+		if !isMateScore(score) {
+			t.Errorf("%d: want a mate score", score)
+		}
+	}
+	for _, score := range []int{0, 900, -900, 100_000} {
+		if isMateScore(score) {
+			t.Errorf("%d: want not a mate score", score)
+		}
+	}
+}
+
+func TestMateDistance(t *testing.T) {
+	tests := []struct {
+		fen         string
+		depth, mate int
+	}{
+		// Ra8# is shorter than the other mates found at depth 4
+		{"6k1/8/6K1/8/8/8/8/R7 w - - 0 1", 4, 1},
+		// Kb8 Rh8#
+		{"k7/8/1K6/8/8/8/8/7R b - - 0 1", 3, -1},
+		{"k7/8/2K5/8/8/8/8/7R w - - 0 1", 4, 2},
+	}
+	for _, tt := range tests {
+		cb, err := board.FromFen(tt.fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mate := 0
+		callbacks := SearchCallbacks{Info: func(info SearchInfo) { mate = info.Mate }}
+		eval, _ := New().Search(cb, SearchLimits{Depth: tt.depth}, callbacks, nil)
+		if mate != tt.mate || mateInMoves(eval) != tt.mate {
+			t.Errorf("%q: want mate %d, got mate %d, eval=%d", tt.fen, tt.mate, mate, eval)
+		}
+	}
+}
+
+func TestScoreTTConversion(t *testing.T) {
+	tests := []struct {
+		score, ply, stored int
+	}{
+		// Mate in 3 ply from the root is mate in 1 ply from ply 2
+		{MATE - 3, 2, MATE - 1},
+		{-MATE + 4, 2, -MATE + 2},
+		{250, 5, 250},
+		{-250, 5, -250},
+	}
+	for _, tt := range tests {
+		if got := scoreToTT(tt.score, tt.ply); got != tt.stored {
+			t.Errorf("scoreToTT(%d, %d): want=%d, got=%d", tt.score, tt.ply, tt.stored, got)
+		}
+		if got := scoreFromTT(tt.stored, tt.ply); got != tt.score {
+			t.Errorf("scoreFromTT(%d, %d): want=%d, got=%d", tt.stored, tt.ply, tt.score, got)
+		}
+	}
+}
+
+func TestIsDraw(t *testing.T) {
+	tests := []struct {
+		name, fen string
+		keys      []uint64
+		want      bool
+	}{
+		{"fifty moves", "4k3/8/8/8/8/8/8/Q3K3 w - - 100 80", nil, true},
+		{"forty-nine and a half moves", "4k3/8/8/8/8/8/8/Q3K3 w - - 99 80", nil, false},
+		{"repetition", "4k3/8/8/8/8/8/8/Q3K3 w - - 4 10", []uint64{0, 1, 2}, true},
+		// The repeated position is older than the last capture or pawn move
+		{"irreversible move", "4k3/8/8/8/8/8/8/Q3K3 w - - 3 10", []uint64{0, 1, 2}, false},
+		// The position with the same pieces had the other side to move
+		{"other side to move", "4k3/8/8/8/8/8/8/Q3K3 w - - 4 10", []uint64{1, 0, 2}, false},
+	}
+	for _, tt := range tests {
+		cb, err := board.FromFen(tt.fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := New().newSearch(1).threads[0]
+		// Index 0 of keys stands for the position itself
+		for _, key := range tt.keys {
+			if key == 0 {
+				st.keys = append(st.keys, cb.Zobrist)
+			} else {
+				st.keys = append(st.keys, key)
+			}
+		}
+		st.keys = append(st.keys, 3)
+		st.historyLen = len(st.keys)
+		if got := st.isDraw(cb, 0); got != tt.want {
+			t.Errorf("%s: want=%v, got=%v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestCheckmateIsNotADraw(t *testing.T) {
+	// The repeated position is checkmate, which ends the game first
+	for _, fen := range []string{"k7/1Q6/1K6/8/8/8/8/8 b - - 4 10", "k7/1Q6/1K6/8/8/8/8/8 b - - 100 80"} {
+		cb, err := board.FromFen(fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := New().newSearch(1).threads[0]
+		st.keys = []uint64{cb.Zobrist, 1, 2, 3}
+		st.historyLen = len(st.keys) - 1
+		line := make([]board.Move, 0)
+		if score, _ := st.negamax(-INFINITY, INFINITY, 2, cb, 1, &line, &pvLine{}); score != -MATE+1 {
+			t.Errorf("%q: want=%d, got=%d", fen, -MATE+1, score)
+		}
+	}
+}
+
+// Return a position where Black, a queen behind, draws by repeating the
+// position after 1. ... Kg7 with Kg7, and the game history before it
+func repetitionGame(t *testing.T) (*board.Board, []uint64) {
+	// 1. ... Kg7 2. Qa2 Kh8 3. Qb1
+	game := []string{
+		"8/6k1/8/8/8/8/8/KQ6 w - - 0 1",
+		"8/6k1/8/8/8/8/Q7/K7 b - - 1 1",
+		"7k/8/8/8/8/8/Q7/K7 w - - 2 2",
+	}
+	history := []uint64{}
+	for _, fen := range game {
+		cb, err := board.FromFen(fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		history = append(history, cb.Zobrist)
+	}
+	cb, err := board.FromFen("7k/8/8/8/8/8/8/KQ6 b - - 3 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cb, history
+}
+
+func TestRepetitionDraw(t *testing.T) {
+	cb, history := repetitionGame(t)
+	kg7 := board.Move{From: 63, To: 54, Piece: pieces.KING, PromoteTo: pieces.NO_PIECE}
+
+	eval, move := New().Search(cb, SearchLimits{Depth: 4, GameHistory: history}, SearchCallbacks{}, nil)
+	if eval != DRAW || move != kg7 {
+		t.Errorf("want Kg7 with a draw, got %v with eval=%d", move, eval)
+	}
+	// Without the game history, Black is lost
+	eval, _ = New().Search(cb, SearchLimits{Depth: 4}, SearchCallbacks{}, nil)
+	if eval >= -500 {
+		t.Errorf("without history: want a losing eval, got %d", eval)
+	}
+}
+
+func TestRepetitionInSingularSearch(t *testing.T) {
+	cb, history := repetitionGame(t)
+	kg8 := board.Move{From: 63, To: 62, Piece: pieces.KING, PromoteTo: pieces.NO_PIECE}
+	const depth = 4
+	st := New().newSearch(1).threads[0]
+	// The root node has stored its own key before the singular search
+	st.keys = append(slices.Clone(history), cb.Zobrist)
+	st.historyLen = len(history)
+	// Kg7 repeats the position, so Kg8 is not singular against a draw
+	if st.isSingular(kg8, SINGULAR_MARGIN*depth, depth, cb, 0) {
+		t.Error("want the repetition after Kg7 to refute Kg8 as singular")
+	}
+	if len(st.keys) != len(history)+1 {
+		t.Errorf("keys: want %d, got %d", len(history)+1, len(st.keys))
+	}
+}
+
+func TestContempt(t *testing.T) {
+	cb, history := repetitionGame(t)
+	limits := SearchLimits{Depth: 4, GameHistory: history}
+	e := New()
+	e.SetContempt(MAX_CONTEMPT + 1)
+	if e.contempt != MAX_CONTEMPT {
+		t.Errorf("contempt: want=%d, got=%d", MAX_CONTEMPT, e.contempt)
+	}
+
+	// A draw is still better than losing the queen ending
+	e.SetContempt(50)
+	if eval, _ := e.Search(cb, limits, SearchCallbacks{}, nil); eval != DRAW-50 {
+		t.Errorf("contempt: want eval=%d, got %d", DRAW-50, eval)
+	}
+	e.SetAnalysisMode(true)
+	if eval, _ := e.Search(cb, limits, SearchCallbacks{}, nil); eval != DRAW {
+		t.Errorf("analysis mode: want eval=%d, got %d", DRAW, eval)
+	}
+}
+
+func TestDrawScore(t *testing.T) {
+	st := New().newSearch(1).threads[0]
+	st.contempt = 30
+	// The root side to move avoids draws, and its opponent seeks them
+	if st.drawScore(0) != -30 || st.drawScore(1) != 30 || st.drawScore(4) != -30 {
+		t.Errorf("want -30 at even plies and 30 at odd plies, got %d, %d, %d",
+			st.drawScore(0), st.drawScore(1), st.drawScore(4))
+	}
+}
+
+func TestStalemate(t *testing.T) {
+	fens := []string{
+		"k7/2Q5/1K6/8/8/8/8/8 b - - 0 1",
+		// The pinned knight has pseudo-legal moves only
+		"7k/4N1n1/7K/8/8/8/8/Q7 b - - 0 1",
+	}
+	for _, fen := range fens {
+		cb, err := board.FromFen(fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := newThreadAtPly(1)
+		st.contempt = 30
+		line := make([]board.Move, 0)
+		if score, _ := st.negamax(-INFINITY, INFINITY, 2, cb, 1, &line, &pvLine{}); score != DRAW+30 {
+			t.Errorf("%q: want=%d, got=%d", fen, DRAW+30, score)
+		}
+	}
+}
+
+func TestIsInsufficientMaterial(t *testing.T) {
+	tests := []struct {
+		fen  string
+		want bool
+	}{
+		{"4k3/8/8/8/8/8/8/4K3 w - - 0 1", true},
+		{"4k3/8/8/8/8/8/8/4KN2 w - - 0 1", true},
+		{"4k3/8/8/8/8/8/8/2B1K3 w - - 0 1", true},
+		// Bishops on squares of one color
+		{"4kb2/8/8/8/8/8/8/2B1K3 w - - 0 1", true},
+		{"2b1k3/8/8/8/8/8/8/2B1K3 w - - 0 1", false},
+		{"4k3/8/8/8/8/8/8/1NN1K3 w - - 0 1", false},
+		{"4k3/8/8/8/8/8/8/4K2R w - - 0 1", false},
+		{"4k3/8/8/8/8/8/4P3/4K3 w - - 0 1", false},
+	}
+	for _, tt := range tests {
+		cb, err := board.FromFen(tt.fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := isInsufficientMaterial(cb); got != tt.want {
+			t.Errorf("%q: want=%v, got=%v", tt.fen, tt.want, got)
+		}
+	}
+}
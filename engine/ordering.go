@@ -0,0 +1,123 @@
+package engine
+
+import (
+	"github.com/j1642/chess-engine-2/board"
+	"slices"
+)
+
+const (
+	// History scores stay within +-HISTORY_MAX
+	HISTORY_MAX = 1 << 14
+
+	// Order scores of moves which are not ordered by history
+	CAPTURE_ORDER     = 4 * HISTORY_MAX
+	KILLER_ORDER      = 3 * HISTORY_MAX
+	COUNTERMOVE_ORDER = 2 * HISTORY_MAX
+)
+
+// Quiet move ordering statistics of one search thread, kept between searches
+type moveOrdering struct {
+	// Two quiet moves per ply which recently caused a beta cutoff
+	killers [MAX_SEARCH_DEPTH + 1][2]board.Move
+	// Butterfly history of quiet cutoffs, indexed by [side][from][to]
+	history [2][64][64]int
+	// Quiet move which refuted the previous move, indexed by the side to move
+	// and the previous move's [from][to]
+	counterMoves [2][64][64]board.Move
+}
+
+type scoredMove struct {
+	move  board.Move
+	score int
+}
+
+// Forget everything, for a new game
+func (mo *moveOrdering) clear() {
+	*mo = moveOrdering{}
+}
+
+// Prepare for a new search of the same game. Killers belong to positions of
+// the previous search, and history fades so that new cutoffs dominate
+func (mo *moveOrdering) age() {
+	mo.killers = [MAX_SEARCH_DEPTH + 1][2]board.Move{}
+	for side := range mo.history {
+		for from := range mo.history[side] {
+			for to := range mo.history[side][from] {
+				mo.history[side][from][to] /= 2
+			}
+		}
+	}
+}
+
+func (mo *moveOrdering) isKiller(ply int, move board.Move) bool {
+	return mo.killers[ply][0] == move || mo.killers[ply][1] == move
+}
+
+// Return the move which refuted the previous move last time, if any
+func (mo *moveOrdering) counterMove(cb *board.Board) board.Move {
+	if cb.PrevMove == emptyMove {
+		return emptyMove
+	}
+	return mo.counterMoves[cb.WToMove][cb.PrevMove.From][cb.PrevMove.To]
+}
+
+// Record a quiet move which caused a beta cutoff. The quiet moves searched
+// before it at the same node are penalized
+func (mo *moveOrdering) updateQuietCutoff(cb *board.Board, move board.Move, ply, depth int, quietsSearched []board.Move) {
+	if mo.killers[ply][0] != move {
+		mo.killers[ply][1] = mo.killers[ply][0]
+		mo.killers[ply][0] = move
+	}
+	if cb.PrevMove != emptyMove {
+		mo.counterMoves[cb.WToMove][cb.PrevMove.From][cb.PrevMove.To] = move
+	}
+
+	bonus := min(depth*depth, HISTORY_MAX)
+	mo.addHistory(cb.WToMove, move, bonus)
+	for _, quiet := range quietsSearched {
+		if quiet != move {
+			mo.addHistory(cb.WToMove, quiet, -bonus)
+		}
+	}
+}
+
+// Add a bonus with gravity: the closer a score is to +-HISTORY_MAX, the less
+// a bonus of the same sign moves it
+func (mo *moveOrdering) addHistory(side uint, move board.Move, bonus int) {
+	entry := &mo.history[side][move.From][move.To]
+	*entry += bonus - *entry*abs(bonus)/HISTORY_MAX
+}
+
+// Sort moves[start:] best first: captures and promotions, killers, the
+// countermove, then quiet moves by history
+func (mo *moveOrdering) order(moves []board.Move, cb *board.Board, ply, start int) {
+	counter := mo.counterMove(cb)
+	scored := make([]scoredMove, 0, len(moves)-start)
+	for _, move := range moves[start:] {
+		score := 0
+		switch {
+		case !isQuiet(move, cb):
+			score = CAPTURE_ORDER
+		case move == mo.killers[ply][0]:
+			score = KILLER_ORDER
+		case move == mo.killers[ply][1]:
+			score = KILLER_ORDER - 1
+		case move == counter:
+			score = COUNTERMOVE_ORDER
+		default:
+			score = mo.history[cb.WToMove][move.From][move.To]
+		}
+		scored = append(scored, scoredMove{move, score})
+	}
+	slices.SortStableFunc(scored, func(a, b scoredMove) int { return b.score - a.score })
+	for i, sm := range scored {
+		moves[start+i] = sm.move
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
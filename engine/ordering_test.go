@@ -0,0 +1,123 @@
+package engine
+
+import (
+	"github.com/j1642/chess-engine-2/board"
+	"github.com/j1642/chess-engine-2/pieces"
+	"slices"
+	"testing"
+)
+
+func quietMove(from, to int8) board.Move {
+	return board.Move{From: from, To: to, Piece: pieces.KNIGHT, PromoteTo: pieces.NO_PIECE}
+}
+
+func TestUpdateQuietCutoff(t *testing.T) {
+	cb := board.New()
+	cb.PrevMove = quietMove(62, 45)
+	mo := &moveOrdering{}
+	first, second, searched := quietMove(1, 18), quietMove(6, 21), quietMove(1, 16)
+
+	mo.updateQuietCutoff(cb, first, 2, 3, nil)
+	mo.updateQuietCutoff(cb, second, 2, 3, []board.Move{searched})
+	mo.updateQuietCutoff(cb, second, 2, 3, nil)
+
+	if mo.killers[2] != [2]board.Move{second, first} {
+		t.Errorf("killers: want=%v, got=%v", [2]board.Move{second, first}, mo.killers[2])
+	}
+	if got := mo.counterMove(cb); got != second {
+		t.Errorf("countermove: want=%v, got=%v", second, got)
+	}
+	if mo.history[1][6][21] <= mo.history[1][1][18] || mo.history[1][1][16] >= 0 {
+		t.Errorf("history: want cutoff moves rewarded and searched moves penalized, got %d, %d, %d",
+			mo.history[1][6][21], mo.history[1][1][18], mo.history[1][1][16])
+	}
+}
+
+func TestHistoryGravity(t *testing.T) {
+	mo := &moveOrdering{}
+	move := quietMove(1, 18)
+	for range 1000 {
+		mo.addHistory(1, move, MAX_SEARCH_DEPTH*MAX_SEARCH_DEPTH)
+	}
+	if got := mo.history[1][1][18]; got > HISTORY_MAX || got < HISTORY_MAX/2 {
+		t.Errorf("want history near %d, got %d", HISTORY_MAX, got)
+	}
+	for range 1000 {
+		mo.addHistory(1, move, -MAX_SEARCH_DEPTH*MAX_SEARCH_DEPTH)
+	}
+	if got := mo.history[1][1][18]; got < -HISTORY_MAX || got > -HISTORY_MAX/2 {
+		t.Errorf("want history near %d, got %d", -HISTORY_MAX, got)
+	}
+}
+
+func TestAgeAndClear(t *testing.T) {
+	cb := board.New()
+	cb.PrevMove = quietMove(62, 45)
+	mo := &moveOrdering{}
+	move := quietMove(1, 18)
+	mo.updateQuietCutoff(cb, move, 0, 4, nil)
+	history := mo.history[1][1][18]
+
+	mo.age()
+	if mo.isKiller(0, move) || mo.history[1][1][18] != history/2 || mo.counterMove(cb) != move {
+		t.Error("age: want killers cleared, history halved and countermoves kept")
+	}
+	mo.clear()
+	if *mo != (moveOrdering{}) {
+		t.Error("clear: want empty tables")
+	}
+}
+
+func TestOrder(t *testing.T) {
+	cb, err := board.FromFen("4k3/8/8/3p4/8/2N5/8/4K1N1 w - - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb.PrevMove = quietMove(60, 59)
+	mo := &moveOrdering{}
+	capture := quietMove(18, 35)
+	killer := quietMove(18, 12)
+	counter := quietMove(6, 21)
+	goodHistory := quietMove(18, 1)
+	mo.killers[1][0] = killer
+	mo.counterMoves[1][60][59] = counter
+	mo.history[1][18][1] = 100
+	mo.history[1][6][23] = -100
+
+	moves := pieces.GetAllMoves(cb)
+	mo.order(moves, cb, 1, 0)
+	want := []board.Move{capture, killer, counter, goodHistory}
+	if !slices.Equal(moves[:4], want) {
+		t.Errorf("want %v first, got %v", want, moves[:4])
+	}
+	if last := moves[len(moves)-1]; last != quietMove(6, 23) {
+		t.Errorf("want the worst history move last, got %v", last)
+	}
+}
+
+func TestNewGameClearsOrdering(t *testing.T) {
+	e := New()
+	e.newSearch(2)
+	e.orderings[1].history[1][1][18] = 100
+	e.newSearch(2)
+	if got := e.orderings[1].history[1][1][18]; got != 50 {
+		t.Errorf("new search: want history aged to 50, got %d", got)
+	}
+	e.NewGame()
+	if got := e.orderings[1].history[1][1][18]; got != 0 {
+		t.Errorf("new game: want history cleared, got %d", got)
+	}
+}
+
+func TestOrderingReducesNodes(t *testing.T) {
+	depth := 5
+	without := features
+	without.ordering = false
+	withoutNodes := countFeatureNodes(t, without, depth)
+	withNodes := countFeatureNodes(t, features, depth)
+	t.Logf("nodes at depth %d: without killers and history=%d, with=%d (%.0f%% fewer)",
+		depth, withoutNodes, withNodes, 100-100*float64(withNodes)/float64(withoutNodes))
+	if withNodes >= withoutNodes {
+		t.Errorf("want fewer nodes than %d, got %d", withoutNodes, withNodes)
+	}
+}
@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"github.com/j1642/chess-engine-2/board"
+	"time"
+)
+
+const (
+	// Minimum time between progress reports, and before the first one
+	PROGRESS_INTERVAL = time.Second
+)
+
+// Counters of the main thread, for tuning and debugging the search
+type SearchStats struct {
+	// Nodes of the full-width search, and of the quiescence search
+	SearchNodes      uint64
+	QNodes           uint64
+	TTProbes         uint64
+	TTHits           uint64
+	BetaCutoffs      uint64
+	FirstMoveCutoffs uint64
+}
+
+// Return the percentage of transposition table probes which found an entry
+func (stats SearchStats) TTHitRate() float64 {
+	return percent(stats.TTHits, stats.TTProbes)
+}
+
+// Return the percentage of full-width nodes which failed high
+func (stats SearchStats) BetaCutoffRate() float64 {
+	return percent(stats.BetaCutoffs, stats.SearchNodes)
+}
+
+// Return the percentage of beta cutoffs caused by the first move searched.
+// Higher is better move ordering
+func (stats SearchStats) FirstMoveCutoffRate() float64 {
+	return percent(stats.FirstMoveCutoffs, stats.BetaCutoffs)
+}
+
+func percent(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// Progress of the main thread during an iteration
+type SearchProgress struct {
+	Depth          int
+	CurrMove       board.Move
+	CurrMoveNumber int
+	Nodes          uint64
+	NPS            uint64
+	Time           time.Duration
+	Hashfull       int
+}
+
+// Return nodes per second
+func nodesPerSecond(nodes uint64, elapsed time.Duration) uint64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return uint64(float64(nodes) / elapsed.Seconds())
+}
+
+// Return the number of moves until mate, negative if the side to move is
+// mated, or 0 if the eval is not a mate
+func mateInMoves(eval int) int {
+	if !isMateScore(eval) {
+		return 0
+	}
+	if eval > 0 {
+		// Mating on an odd ply from the root
+		return (MATE - eval + 1) / 2
+	}
+	return -(MATE + eval) / 2
+}
@@ -0,0 +1,101 @@
+package engine
+
+import (
+	"github.com/j1642/chess-engine-2/board"
+	"github.com/j1642/chess-engine-2/pieces"
+	"slices"
+	"testing"
+	"time"
+)
+
+type mateInMovesTestCase struct {
+	eval, expected int
+}
+
+func TestMateInMoves(t *testing.T) {
+	tests := []mateInMovesTestCase{
+		{eval: MATE - 1, expected: 1},
+		{eval: MATE - 3, expected: 2},
+		{eval: -MATE + 2, expected: -1},
+		{eval: -MATE + 4, expected: -2},
+		// Mated by a quiescence leaf evaluation at the root
+		{eval: -MATE, expected: 0},
+		{eval: 300, expected: 0},
+		{eval: -300, expected: 0},
+	}
+	for _, tt := range tests {
+		if actual := mateInMoves(tt.eval); actual != tt.expected {
+			t.Errorf("eval=%d: want=%d, got=%d", tt.eval, tt.expected, actual)
+		}
+	}
+}
+
+func TestSearchStatsRates(t *testing.T) {
+	stats := SearchStats{SearchNodes: 40, TTProbes: 200, TTHits: 50, BetaCutoffs: 10, FirstMoveCutoffs: 9}
+	if rate := stats.TTHitRate(); rate != 25 {
+		t.Errorf("TT hit rate: want=25, got=%f", rate)
+	}
+	if rate := stats.BetaCutoffRate(); rate != 25 {
+		t.Errorf("beta cutoff rate: want=25, got=%f", rate)
+	}
+	if rate := stats.FirstMoveCutoffRate(); rate != 90 {
+		t.Errorf("first move cutoff rate: want=90, got=%f", rate)
+	}
+	if rate := (SearchStats{}).TTHitRate(); rate != 0 {
+		t.Errorf("TT hit rate without probes: want=0, got=%f", rate)
+	}
+}
+
+func TestSearchInfoStats(t *testing.T) {
+	cb, err := board.FromFen("r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R w KQkq - 2 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos := []SearchInfo{}
+	callbacks := SearchCallbacks{Info: func(info SearchInfo) { infos = append(infos, info) }}
+	New().Search(cb, SearchLimits{Depth: 3}, callbacks, nil)
+
+	for i, info := range infos {
+		if info.SelDepth < info.Depth {
+			t.Errorf("info[%d]: seldepth %d < depth %d", i, info.SelDepth, info.Depth)
+		}
+		if i > 0 && info.Nodes <= infos[i-1].Nodes {
+			t.Errorf("info[%d]: nodes did not increase: %d", i, info.Nodes)
+		}
+		// The root has a full window, so the first cutoffs are at depth 2
+		if info.Stats.QNodes == 0 || info.Stats.QNodes > info.Nodes || (info.Depth > 1) != (info.Stats.BetaCutoffs > 0) {
+			t.Errorf("info[%d]: unexpected stats %+v for %d nodes", i, info.Stats, info.Nodes)
+		}
+	}
+}
+
+func TestSearchProgress(t *testing.T) {
+	// Each reading of the clock takes a second, so every root move is reported
+	useFakeClock(t, PROGRESS_INTERVAL)
+	cb := board.New()
+	progress := []SearchProgress{}
+	callbacks := SearchCallbacks{Progress: func(p SearchProgress) { progress = append(progress, p) }}
+	New().Search(cb, SearchLimits{Depth: 2}, callbacks, nil)
+
+	legalMoves := pieces.GetLegalMoves(cb)
+	if len(progress) != 2*len(legalMoves) {
+		t.Fatalf("progress reports: want=%d, got=%d", 2*len(legalMoves), len(progress))
+	}
+	for i, p := range progress {
+		if p.Depth != i/len(legalMoves)+1 || p.CurrMoveNumber != i%len(legalMoves)+1 {
+			t.Errorf("progress[%d]: want depth=%d currmovenumber=%d, got %+v",
+				i, i/len(legalMoves)+1, i%len(legalMoves)+1, p)
+		}
+		if !slices.Contains(legalMoves, p.CurrMove) || p.Time < PROGRESS_INTERVAL {
+			t.Errorf("progress[%d]: %+v", i, p)
+		}
+	}
+
+	// A slow clock throttles the reports
+	useFakeClock(t, time.Millisecond)
+	progress = progress[:0]
+	New().Search(cb, SearchLimits{Depth: 2}, callbacks, nil)
+	if len(progress) != 0 {
+		t.Errorf("progress reports within %v: want=0, got=%d", PROGRESS_INTERVAL, len(progress))
+	}
+}
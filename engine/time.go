@@ -0,0 +1,122 @@
+package engine
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Time management: convert the clock state from the UCI go command into a
+// soft limit, after which no new iteration starts, and a hard limit, at which
+// the search is aborted.
+
+const (
+	DEFAULT_MOVE_OVERHEAD = 10 // milliseconds
+	MAX_MOVE_OVERHEAD     = 5000
+	// Moves left in the game when the GUI does not send movestogo
+	DEFAULT_MOVES_TO_GO = 30
+	// The hard limit is at most this many times the soft limit
+	HARD_LIMIT_FACTOR = 4
+)
+
+// Clock fields of the UCI go command, in milliseconds. Time and Inc are
+// indexed by color, [black, white]. A zero value means the field was not sent
+type TimeControl struct {
+	Time, Inc [2]int
+	MovesToGo int
+	MoveTime  int
+}
+
+// Set the time reserved for communication with the GUI, in milliseconds
+func (e *Engine) SetMoveOverhead(ms int) {
+	e.moveOverhead = max(0, min(ms, MAX_MOVE_OVERHEAD))
+}
+
+func SetMoveOverhead(ms int) {
+	defaultEngine.SetMoveOverhead(ms)
+}
+
+// Return the soft and hard time limits for the side to move, or false if the
+// search is not limited by time
+func (tc TimeControl) limits(color uint, overhead time.Duration) (time.Duration, time.Duration, bool) {
+	ms := time.Millisecond
+	if tc.MoveTime > 0 {
+		limit := max(ms, time.Duration(tc.MoveTime)*ms-overhead)
+		return limit, limit, true
+	}
+	if tc.Time[color] <= 0 {
+		return 0, 0, false
+	}
+
+	remaining := max(ms, time.Duration(tc.Time[color])*ms-overhead)
+	movesToGo := DEFAULT_MOVES_TO_GO
+	if tc.MovesToGo > 0 {
+		movesToGo = min(tc.MovesToGo, DEFAULT_MOVES_TO_GO)
+	}
+	soft := remaining/time.Duration(movesToGo) + time.Duration(tc.Inc[color])*ms*3/4
+	// Never plan to use most of the remaining time on one move
+	hard := min(soft*HARD_LIMIT_FACTOR, remaining*3/4)
+	soft = min(soft, hard)
+	return max(ms, soft), max(ms, hard), true
+}
+
+// Time limits of one search. The clock starts with the search, or on
+// ponderhit when the search is pondering
+type searchTimer struct {
+	soft, hard time.Duration
+	timed      bool
+
+	mu          sync.Mutex
+	started     bool
+	startTime   time.Time
+	cancelTimer func() bool
+}
+
+// Start the clock and set stop at the hard limit. Later calls do nothing
+func (t *searchTimer) start(stop *atomic.Bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.started {
+		return
+	}
+	t.started, t.startTime = true, searchClock.Now()
+	if t.timed {
+		t.cancelTimer = searchClock.AfterFunc(t.hard, func() { stop.Store(true) })
+	}
+}
+
+// Return true if no new iteration should start
+func (t *searchTimer) softLimitReached() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.timed && t.started && searchClock.Now().Sub(t.startTime) >= t.soft
+}
+
+// Cancel the hard limit
+func (t *searchTimer) cancel() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cancelTimer != nil {
+		t.cancelTimer()
+	}
+}
+
+// Source of time for the search, replaced by a fake clock in tests
+type clock interface {
+	Now() time.Time
+	// Call f in its own goroutine after duration d. The returned function
+	// cancels the call
+	AfterFunc(d time.Duration, f func()) func() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+var searchClock clock = realClock{}
@@ -0,0 +1,295 @@
+package engine
+
+import (
+	"github.com/j1642/chess-engine-2/board"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Clock which only moves when advanced. Every call to Now() advances it by
+// tick, so each iteration of a search appears to take some time
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	tick   time.Duration
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	when      time.Time
+	f         func()
+	cancelled bool
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	now := c.now
+	c.mu.Unlock()
+	c.Advance(c.tick)
+	return now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) func() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := &fakeTimer{when: c.now.Add(d), f: f}
+	c.timers = append(c.timers, timer)
+	return func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		wasActive := !timer.cancelled
+		timer.cancelled = true
+		return wasActive
+	}
+}
+
+// Move the clock forward, running the timers which expire
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	expired := []func(){}
+	for _, timer := range c.timers {
+		if !timer.cancelled && !c.now.Before(timer.when) {
+			timer.cancelled = true
+			expired = append(expired, timer.f)
+		}
+	}
+	c.mu.Unlock()
+	for _, f := range expired {
+		f()
+	}
+}
+
+func (c *fakeClock) timerCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// Replace the search clock for the duration of a test
+func useFakeClock(t *testing.T, tick time.Duration) *fakeClock {
+	c := &fakeClock{now: time.Unix(0, 0), tick: tick}
+	searchClock = c
+	t.Cleanup(func() { searchClock = realClock{} })
+	return c
+}
+
+type timeLimitsTestCase struct {
+	tc         TimeControl
+	color      uint
+	soft, hard time.Duration
+	timed      bool
+	name       string
+}
+
+func TestTimeControlLimits(t *testing.T) {
+	ms := time.Millisecond
+	overhead := 10 * ms
+	tests := []timeLimitsTestCase{
+		{
+			name: "no clock",
+		},
+		{
+			tc:    TimeControl{MoveTime: 500},
+			color: 1,
+			soft:  490 * ms, hard: 490 * ms, timed: true,
+			name: "movetime",
+		},
+		{
+			tc:   TimeControl{MoveTime: 5},
+			soft: ms, hard: ms, timed: true,
+			name: "movetime below overhead",
+		},
+		{
+			tc:    TimeControl{Time: [2]int{60010, 1000}},
+			color: 0,
+			soft:  2000 * ms, hard: 8000 * ms, timed: true,
+			name: "black sudden death",
+		},
+		{
+			tc:    TimeControl{Time: [2]int{60010, 1000}},
+			color: 1,
+			soft:  33 * ms, hard: 132 * ms, timed: true,
+			name: "white uses its own clock",
+		},
+		{
+			tc:    TimeControl{Time: [2]int{0, 30010}, Inc: [2]int{0, 2000}},
+			color: 1,
+			soft:  2500 * ms, hard: 10000 * ms, timed: true,
+			name: "increment",
+		},
+		{
+			tc:    TimeControl{Time: [2]int{0, 10010}, MovesToGo: 5},
+			color: 1,
+			soft:  2000 * ms, hard: 7500 * ms, timed: true,
+			name: "moves to go caps the hard limit",
+		},
+		{
+			tc:    TimeControl{Time: [2]int{0, 10010}, MovesToGo: 1},
+			color: 1,
+			soft:  7500 * ms, hard: 7500 * ms, timed: true,
+			name: "last move before the time control",
+		},
+		{
+			tc:    TimeControl{Time: [2]int{0, 60010}},
+			color: 0,
+			name:  "no time for the side to move",
+		},
+	}
+
+	for _, tt := range tests {
+		soft, hard, timed := tt.tc.limits(tt.color, overhead)
+		if soft != tt.soft || hard != tt.hard || timed != tt.timed {
+			t.Errorf("%s: want=(%v, %v, %v), got=(%v, %v, %v)", tt.name,
+				tt.soft, tt.hard, tt.timed, soft, hard, timed)
+		}
+	}
+}
+
+func TestSearchStopsAtSoftLimit(t *testing.T) {
+	defer SetMoveOverhead(DEFAULT_MOVE_OVERHEAD)
+	SetMoveOverhead(0)
+	// Each iteration appears to take 100 ms, so a 250 ms search completes
+	// three iterations instead of MAX_SEARCH_DEPTH
+	useFakeClock(t, 100*time.Millisecond)
+	cb, err := board.FromFen("8/8/8/4k3/8/8/3PK3/8 w - - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan board.Move)
+	go func() {
+		_, move := Search(cb, SearchLimits{Time: TimeControl{MoveTime: 250}})
+		done <- move
+	}()
+	select {
+	case move := <-done:
+		if move == emptyMove {
+			t.Error("timed search returned an empty move")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("search did not stop at the soft limit")
+	}
+}
+
+func TestSearchAbortsAtHardLimit(t *testing.T) {
+	c := useFakeClock(t, 0)
+	cb, err := board.FromFen("r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R w KQkq - 2 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan board.Move)
+	go func() {
+		_, move := Search(cb, SearchLimits{Time: TimeControl{Time: [2]int{0, 60000}}})
+		done <- move
+	}()
+	// The clock does not tick, so only the hard limit timer can end the search
+	for c.timerCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Let the first iterations complete
+	time.Sleep(200 * time.Millisecond)
+	c.Advance(time.Minute)
+
+	select {
+	case move := <-done:
+		if move == emptyMove {
+			t.Error("aborted search returned an empty move")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("search was not aborted at the hard limit")
+	}
+}
+
+func TestPonderHitStartsClock(t *testing.T) {
+	c := useFakeClock(t, 0)
+	cb, err := board.FromFen("r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R w KQkq - 2 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ponderHit := make(chan bool, 1)
+	done := make(chan board.Move)
+	go func() {
+		limits := SearchLimits{Time: TimeControl{Time: [2]int{0, 60000}}, PonderHit: ponderHit}
+		_, move := Search(cb, limits)
+		done <- move
+	}()
+	// Pondering ignores the clock
+	time.Sleep(100 * time.Millisecond)
+	if c.timerCount() != 0 {
+		t.Fatal("pondering search set a hard time limit")
+	}
+	ponderHit <- true
+	for c.timerCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	c.Advance(time.Minute)
+
+	select {
+	case move := <-done:
+		if move == emptyMove {
+			t.Error("search after ponderhit returned an empty move")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("search after ponderhit was not aborted at the hard limit")
+	}
+}
+
+func TestStopWhilePondering(t *testing.T) {
+	cb, err := board.FromFen("8/8/8/4k3/8/8/3PK3/8 w - - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan bool, 1)
+	done := make(chan board.Move)
+	go func() {
+		// The depth is reached quickly, then the search waits for stop
+		_, move := Search(cb, SearchLimits{Depth: 2, PonderHit: make(chan bool)}, stop)
+		done <- move
+	}()
+	select {
+	case <-done:
+		t.Fatal("pondering search returned before stop")
+	case <-time.After(100 * time.Millisecond):
+	}
+	stop <- true
+	select {
+	case move := <-done:
+		if move == emptyMove {
+			t.Error("stopped ponder returned an empty move")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("stop did not end the ponder")
+	}
+}
+
+func TestStopWhileInfinite(t *testing.T) {
+	cb, err := board.FromFen("4k3/8/8/8/8/8/8/4K3 w - - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan bool, 1)
+	done := make(chan board.Move)
+	go func() {
+		// MAX_SEARCH_DEPTH is reached quickly, then the search waits for stop
+		_, move := Search(cb, SearchLimits{Infinite: true}, stop)
+		done <- move
+	}()
+	select {
+	case <-done:
+		t.Fatal("infinite search returned before stop")
+	case <-time.After(100 * time.Millisecond):
+	}
+	stop <- true
+	select {
+	case move := <-done:
+		if move == emptyMove {
+			t.Error("stopped infinite search returned an empty move")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("stop did not end the infinite search")
+	}
+}
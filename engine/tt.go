@@ -0,0 +1,184 @@
+package engine
+
+import (
+	"sync/atomic"
+
+	"github.com/j1642/chess-engine-2/board"
+)
+
+// Transposition table (TT): a fixed size hash table of searched positions.
+//
+// Each bucket holds BUCKET_SIZE slots and fills one 64 byte cache line. The
+// low bits of a Zobrist hash select the bucket, and the full hash is stored
+// in the slot to verify that an entry belongs to the probed position. The first
+// slots of a bucket are depth-preferred, and the last slot is always replaced.
+//
+// Search threads share the table without locks. A slot stores its key XORed
+// with its data, so a slot torn by concurrent writes fails the key check
+// instead of returning another position's data.
+
+type TtEntry struct {
+	Eval                 int
+	Move                 board.Move
+	NodeType, Age, Depth uint8
+}
+
+const (
+	DEFAULT_HASH_MB = 16
+	MIN_HASH_MB     = 1
+	MAX_HASH_MB     = 32768
+
+	BUCKET_SIZE = 4
+	// Bytes per bucket, used to convert megabytes to a bucket count
+	BUCKET_BYTES = BUCKET_SIZE * 16
+	// Entries do not store more than 7 bits of depth or 4 bits of age
+	MAX_TT_DEPTH = 1<<7 - 1
+	AGE_MASK     = 1<<4 - 1
+)
+
+type ttSlot struct {
+	key  atomic.Uint64 // Zobrist hash XOR data, 0 for an empty slot
+	data atomic.Uint64 // packed TtEntry
+}
+
+// Return the slot's Zobrist hash, which is 0 for an empty slot, and its data
+func (slot *ttSlot) load() (uint64, uint64) {
+	data := slot.data.Load()
+	return slot.key.Load() ^ data, data
+}
+
+func (slot *ttSlot) store(hash, data uint64) {
+	slot.key.Store(hash ^ data)
+	slot.data.Store(data)
+}
+
+type ttBucket [BUCKET_SIZE]ttSlot
+
+type TranspositionTable struct {
+	buckets    []ttBucket
+	mask       uint64
+	generation uint8
+}
+
+// Return a table using at most `mb` megabytes. The bucket count is a power of two
+func NewTranspositionTable(mb int) *TranspositionTable {
+	tt := &TranspositionTable{}
+	tt.Resize(mb)
+	return tt
+}
+
+// Reallocate the table to use at most `mb` megabytes, discarding all entries.
+// Resize and Clear must not be called during a search
+func (tt *TranspositionTable) Resize(mb int) {
+	mb = max(MIN_HASH_MB, min(mb, MAX_HASH_MB))
+	count := uint64(1)
+	for count*2*BUCKET_BYTES <= uint64(mb)<<20 {
+		count *= 2
+	}
+	tt.buckets = make([]ttBucket, count)
+	tt.mask = count - 1
+	tt.generation = 0
+}
+
+func (tt *TranspositionTable) Clear() {
+	clear(tt.buckets)
+	tt.generation = 0
+}
+
+// Mark entries from previous searches as old, so they are replaced first
+func (tt *TranspositionTable) NewSearch() {
+	tt.generation = (tt.generation + 1) & AGE_MASK
+}
+
+func (tt *TranspositionTable) Probe(hash uint64) (TtEntry, bool) {
+	bucket := &tt.buckets[hash&tt.mask]
+	for i := range bucket {
+		if key, data := bucket[i].load(); key == hash {
+			return unpackEntry(data), true
+		}
+	}
+	return TtEntry{}, false
+}
+
+// Store an entry, setting its age to the current search. Entry.Depth above
+// MAX_TT_DEPTH is stored as MAX_TT_DEPTH
+func (tt *TranspositionTable) Store(hash uint64, entry TtEntry) {
+	entry.Age = tt.generation
+	entry.Depth = min(entry.Depth, MAX_TT_DEPTH)
+	bucket := &tt.buckets[hash&tt.mask]
+
+	// Update the position's existing entry unless it is deeper and current
+	for i := range bucket {
+		if key, data := bucket[i].load(); key == hash {
+			stored := unpackEntry(data)
+			if entry.Depth >= stored.Depth || stored.Age != tt.generation {
+				bucket[i].store(hash, packEntry(entry))
+			}
+			return
+		}
+	}
+
+	// Replace the shallowest depth-preferred slot, preferring empty and old
+	// slots. Shallow entries go in the always-replace slot instead
+	victim := 0
+	victimValue := MAX_TT_DEPTH + 1
+	for i := range BUCKET_SIZE - 1 {
+		key, data := bucket[i].load()
+		stored := unpackEntry(data)
+		value := int(stored.Depth)
+		if key == 0 || stored.Age != tt.generation {
+			value = -1
+		}
+		if value < victimValue {
+			victim = i
+			victimValue = value
+		}
+	}
+	if lastKey, _ := bucket[BUCKET_SIZE-1].load(); int(entry.Depth) < victimValue || (victimValue >= 0 && lastKey == 0) {
+		victim = BUCKET_SIZE - 1
+	}
+	bucket[victim].store(hash, packEntry(entry))
+}
+
+// Return the permille of sampled slots which hold an entry from the current search
+func (tt *TranspositionTable) Hashfull() int {
+	sampled := min(len(tt.buckets), 1000/BUCKET_SIZE)
+	used := 0
+	for b := range tt.buckets[:sampled] {
+		for i := range tt.buckets[b] {
+			if key, data := tt.buckets[b][i].load(); key != 0 && unpackEntry(data).Age == tt.generation {
+				used++
+			}
+		}
+	}
+	return used * 1000 / (sampled * BUCKET_SIZE)
+}
+
+// Data layout, from the least significant bit: move from (6 bits), move to
+// (6), piece (3), promotion piece (4), depth (7), node type (2), age (4), eval (32)
+func packEntry(entry TtEntry) uint64 {
+	data := uint64(entry.Move.From)
+	data |= uint64(entry.Move.To) << 6
+	data |= uint64(entry.Move.Piece) << 12
+	data |= uint64(entry.Move.PromoteTo) << 15
+	data |= uint64(entry.Depth) << 19
+	data |= uint64(entry.NodeType) << 26
+	data |= uint64(entry.Age) << 28
+	data |= uint64(uint32(int32(entry.Eval))) << 32
+	return data
+}
+
+func unpackEntry(data uint64) TtEntry {
+	return TtEntry{
+		Move: board.Move{
+			From:      int8(data & 0x3f),
+			To:        int8(data >> 6 & 0x3f),
+			Piece:     uint8(data >> 12 & 0x7),
+			PromoteTo: uint8(data >> 15 & 0xf),
+		},
+		Depth:    uint8(data >> 19 & MAX_TT_DEPTH),
+		NodeType: uint8(data >> 26 & 0x3),
+		Age:      uint8(data >> 28 & AGE_MASK),
+		Eval:     int(int32(uint32(data >> 32))),
+	}
+}
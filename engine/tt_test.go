@@ -0,0 +1,139 @@
+package engine
+
+import (
+	"github.com/j1642/chess-engine-2/board"
+	"github.com/j1642/chess-engine-2/pieces"
+	"sync"
+	"testing"
+)
+
+func TestPackEntry(t *testing.T) {
+	entries := []TtEntry{
+		{},
+		{Eval: -MATE, Move: board.Move{From: 63, To: 0, Piece: pieces.KING, PromoteTo: pieces.NO_PIECE},
+			NodeType: CUT_NODE, Age: AGE_MASK, Depth: MAX_TT_DEPTH},
+		{Eval: 1 << 30, Move: board.Move{From: 49, To: 57, Piece: pieces.PAWN, PromoteTo: pieces.KNIGHT},
+			NodeType: ALL_NODE, Age: 3, Depth: 12},
+	}
+	for i, entry := range entries {
+		if actual := unpackEntry(packEntry(entry)); actual != entry {
+			t.Errorf("entry[%d]: want=%v, got=%v", i, entry, actual)
+		}
+	}
+}
+
+func TestTranspositionTableProbe(t *testing.T) {
+	tt := NewTranspositionTable(1)
+	if len(tt.buckets)&(len(tt.buckets)-1) != 0 || len(tt.buckets)*BUCKET_BYTES > 1<<20 {
+		t.Errorf("bucket count: want a power of two within 1 MB, got=%d", len(tt.buckets))
+	}
+
+	hash := uint64(0xabcdef0123456789)
+	entry := TtEntry{Eval: -250, Move: board.Move{From: 12, To: 28}, NodeType: CUT_NODE, Depth: 5}
+	tt.Store(hash, entry)
+
+	stored, ok := tt.Probe(hash)
+	if !ok || stored != entry {
+		t.Errorf("probe: want=%v, got=%v (found=%v)", entry, stored, ok)
+	}
+	// Same bucket index, different position
+	if _, ok = tt.Probe(hash ^ 1<<63); ok {
+		t.Error("probe with a different hash in the same bucket should miss")
+	}
+
+	tt.Clear()
+	if _, ok = tt.Probe(hash); ok {
+		t.Error("probe after Clear() should miss")
+	}
+}
+
+func TestTranspositionTableReplacement(t *testing.T) {
+	tt := NewTranspositionTable(1)
+	// Hashes sharing bucket 0
+	hashes := [6]uint64{}
+	for i := range hashes {
+		hashes[i] = uint64(i+1) << 40
+	}
+
+	// Fill the depth-preferred slots, then add a shallow entry
+	for i := range BUCKET_SIZE - 1 {
+		tt.Store(hashes[i], TtEntry{Depth: 10})
+	}
+	tt.Store(hashes[3], TtEntry{Depth: 1})
+	for i := range 4 {
+		if _, ok := tt.Probe(hashes[i]); !ok {
+			t.Errorf("hash[%d] should be stored", i)
+		}
+	}
+
+	// Another shallow entry replaces the always-replace slot only
+	tt.Store(hashes[4], TtEntry{Depth: 2})
+	if _, ok := tt.Probe(hashes[3]); ok {
+		t.Error("always-replace slot was not replaced")
+	}
+	for i := range BUCKET_SIZE - 1 {
+		if _, ok := tt.Probe(hashes[i]); !ok {
+			t.Errorf("deep entry hash[%d] was replaced by a shallow entry", i)
+		}
+	}
+
+	// A shallower entry for the same position does not overwrite a deeper one
+	tt.Store(hashes[0], TtEntry{Depth: 3, Eval: 7})
+	if stored, _ := tt.Probe(hashes[0]); stored.Depth != 10 {
+		t.Errorf("depth: want=10, got=%d", stored.Depth)
+	}
+
+	// Entries from previous searches are replaced first, even if they are deeper
+	tt.NewSearch()
+	tt.Store(hashes[5], TtEntry{Depth: 1})
+	stored, ok := tt.Probe(hashes[5])
+	if !ok || stored.Age != tt.generation {
+		t.Errorf("new entry: want age=%d, got %v (found=%v)", tt.generation, stored, ok)
+	}
+	if _, ok := tt.Probe(hashes[4]); !ok {
+		t.Error("the always-replace slot should be kept when old entries can be replaced")
+	}
+}
+
+func TestHashfull(t *testing.T) {
+	tt := NewTranspositionTable(1)
+	if tt.Hashfull() != 0 {
+		t.Errorf("empty table hashfull: want=0, got=%d", tt.Hashfull())
+	}
+	// Fill every slot of the sampled buckets
+	for i := range 1000 / BUCKET_SIZE {
+		for j := range BUCKET_SIZE {
+			tt.Store(uint64(j+1)<<40|uint64(i), TtEntry{Depth: 10})
+		}
+	}
+	if tt.Hashfull() != 1000 {
+		t.Errorf("full table hashfull: want=1000, got=%d", tt.Hashfull())
+	}
+	tt.NewSearch()
+	if tt.Hashfull() != 0 {
+		t.Errorf("hashfull counts only the current search: want=0, got=%d", tt.Hashfull())
+	}
+}
+
+func TestTranspositionTableConcurrentAccess(t *testing.T) {
+	tt := NewTranspositionTable(1)
+	// Positions sharing bucket 0, each stored with its own eval. A torn slot
+	// would return an eval belonging to a different position
+	var wg sync.WaitGroup
+	for g := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 20000 {
+				k := (i*7+g)%16 + 1
+				hash := uint64(k) << 40
+				tt.Store(hash, TtEntry{Eval: k, Depth: uint8(i % 20)})
+				if stored, ok := tt.Probe(hash); ok && stored.Eval != k {
+					t.Errorf("hash %x: want eval=%d, got=%d", hash, k, stored.Eval)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -11,6 +11,12 @@ var Pawn = makePawnBBs()
 var Knight = makeKnightBBs()
 var King = makeKingBBs()
 
+// Between[a][b] is the set of squares strictly between a and b, and Line[a][b]
+// is the full rank, file, or diagonal through both squares. Both are 0 when
+// the squares do not share a line.
+var Between = makeBetweenBBs()
+var Line = makeLineBBs()
+
 var RookRelevantOccs [64]uint64
 var RookOneBitCounts [64]int
 
@@ -55,6 +61,45 @@ func makeSlidingAttackBBs() [8][64]uint64 {
 	return bbs
 }
 
+// Return the squares between each pair of squares which share a rank, file,
+// or diagonal, excluding both endpoints
+func makeBetweenBBs() [64][64]uint64 {
+	bbs := [64][64]uint64{}
+	for dir := range Sliding {
+		for from := 0; from < 64; from++ {
+			ray := Sliding[dir][from]
+			for ray > 0 {
+				to := bits.TrailingZeros64(ray)
+				// Squares beyond `to` in the same direction are in Sliding[dir][to]
+				bbs[from][to] = Sliding[dir][from] & ^Sliding[dir][to] & ^uint64(1<<to)
+				ray &= ray - 1
+			}
+		}
+	}
+
+	return bbs
+}
+
+// Return the edge-to-edge line through each pair of squares which share a
+// rank, file, or diagonal, including both squares
+func makeLineBBs() [64][64]uint64 {
+	bbs := [64][64]uint64{}
+	for dir := range Sliding {
+		// Directions are ordered clockwise, so the opposite direction is 4 away
+		opposite := (dir + 4) % 8
+		for from := 0; from < 64; from++ {
+			line := Sliding[dir][from] | Sliding[opposite][from] | uint64(1<<from)
+			ray := Sliding[dir][from]
+			for ray > 0 {
+				bbs[from][bits.TrailingZeros64(ray)] = line
+				ray &= ray - 1
+			}
+		}
+	}
+
+	return bbs
+}
+
 // Return pawn attack bitboards so attacks aren't repeatedly calculated on the fly
 func makePawnBBs() [2][64]uint64 {
 	// First index is cb.WToMove: 1 for white pawns, 0 for black pawns.
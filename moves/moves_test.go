@@ -262,6 +262,83 @@ func TestKingBBs(t *testing.T) {
 	runMoveBBTests(t, tests)
 }
 
+func TestBetweenBBs(t *testing.T) {
+	bbs := makeBetweenBBs()
+	tests := []bbTestCase{
+		{
+			square:   0,
+			expected: uint64(1<<8 + 1<<16 + 1<<24),
+			actual:   bbs[0][32],
+			name:     "between a1 and a5",
+		},
+		{
+			square:   60,
+			expected: uint64(1<<53 + 1<<46),
+			actual:   bbs[60][39],
+			name:     "between e8 and h5",
+		},
+		{
+			square:   7,
+			expected: uint64(1<<1 + 1<<2 + 1<<3 + 1<<4 + 1<<5 + 1<<6),
+			actual:   bbs[7][0],
+			name:     "between h1 and a1",
+		},
+		{
+			square:   9,
+			expected: uint64(0),
+			actual:   bbs[9][10],
+			name:     "adjacent squares",
+		},
+		{
+			// h1 and a2 are 7 squares apart, but not on a diagonal
+			square:   7,
+			expected: uint64(0),
+			actual:   bbs[7][8],
+			name:     "unaligned squares",
+		},
+	}
+
+	runMoveBBTests(t, tests)
+}
+
+func TestLineBBs(t *testing.T) {
+	bbs := makeLineBBs()
+	tests := []bbTestCase{
+		{
+			square:   9,
+			expected: uint64(0x101010101010101) << 1,
+			actual:   bbs[9][49],
+			name:     "b file",
+		},
+		{
+			square:   27,
+			expected: uint64(0x8040201008040201),
+			actual:   bbs[27][9],
+			name:     "a1-h8 diagonal",
+		},
+		{
+			square:   27,
+			expected: uint64(0x8040201008040201),
+			actual:   bbs[63][0],
+			name:     "a1-h8 diagonal from the corners",
+		},
+		{
+			square:   20,
+			expected: uint64(0xff) << 16,
+			actual:   bbs[20][17],
+			name:     "third rank",
+		},
+		{
+			square:   0,
+			expected: uint64(0),
+			actual:   bbs[0][17],
+			name:     "unaligned squares",
+		},
+	}
+
+	runMoveBBTests(t, tests)
+}
+
 func TestCalculateBishopMoves(t *testing.T) {
 	cb := board.New()
 	tests := []moveTestCase{
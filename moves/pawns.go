@@ -0,0 +1,107 @@
+package moves
+
+// Whole-bitboard (setwise) pawn moves and attacks. The color argument matches
+// cb.WToMove: 1 for white pawns, 0 for black pawns.
+
+const (
+	FILE_A = uint64(0x101010101010101)
+	FILE_H = FILE_A << 7
+
+	RANK_1 = uint64(0xff)
+	RANK_3 = RANK_1 << 16
+	RANK_4 = RANK_1 << 24
+	RANK_5 = RANK_1 << 32
+	RANK_6 = RANK_1 << 40
+	RANK_8 = RANK_1 << 56
+)
+
+// Squares on which pawns of each color promote, indexed by color
+var PromotionRanks = [2]uint64{RANK_1, RANK_8}
+
+// Offsets of pawn single pushes, double pushes, west captures and east
+// captures, indexed by color. A move's from-square is its to-square minus the
+// offset.
+var PawnPushOffsets = [2]int8{-8, 8}
+var PawnDoublePushOffsets = [2]int8{-16, 16}
+var PawnWestOffsets = [2]int8{-9, 7}
+var PawnEastOffsets = [2]int8{-7, 9}
+
+// Shift a bitboard one rank toward the promotion rank of `color`
+func pawnForward(bb uint64, color uint) uint64 {
+	if color == 1 {
+		return bb << 8
+	}
+	return bb >> 8
+}
+
+// Return the target squares of pawns pushing one square into empty squares
+func PawnSinglePushes(pawns, empty uint64, color uint) uint64 {
+	return pawnForward(pawns, color) & empty
+}
+
+// Return the target squares of pawns pushing two squares from their starting
+// rank. Both squares in front of the pawn must be empty
+func PawnDoublePushes(pawns, empty uint64, color uint) uint64 {
+	doublePushRanks := [2]uint64{RANK_5, RANK_4}
+	return pawnForward(PawnSinglePushes(pawns, empty, color), color) &
+		empty & doublePushRanks[color]
+}
+
+// Return squares attacked toward the A file
+func PawnWestAttacks(pawns uint64, color uint) uint64 {
+	return pawnForward(pawns & ^FILE_A, color) >> 1
+}
+
+// Return squares attacked toward the H file
+func PawnEastAttacks(pawns uint64, color uint) uint64 {
+	return pawnForward(pawns & ^FILE_H, color) << 1
+}
+
+func PawnAttacks(pawns uint64, color uint) uint64 {
+	return PawnWestAttacks(pawns, color) | PawnEastAttacks(pawns, color)
+}
+
+// Return the pawns which can capture en passant on epSquare. Square 100 means
+// there is no en passant square
+func PawnEpCapturers(pawns uint64, epSquare int8, color uint) uint64 {
+	if epSquare == 100 {
+		return 0
+	}
+	// A pawn attacks the e.p. square if an enemy pawn on that square would
+	// attack it
+	return pawns & PawnAttacks(uint64(1<<epSquare), 1^color)
+}
+
+// Return the pawns which cannot push because the square in front is occupied
+func BlockedPawns(pawns, occupied uint64, color uint) uint64 {
+	return pawns & pawnForward(occupied, 1^color)
+}
+
+// Return every square in front of the pawns, up to the edge of the board
+func PawnFrontSpans(pawns uint64, color uint) uint64 {
+	span := pawnForward(pawns, color)
+	if color == 1 {
+		span |= span << 8
+		span |= span << 16
+		span |= span << 32
+	} else {
+		span |= span >> 8
+		span |= span >> 16
+		span |= span >> 32
+	}
+	return span
+}
+
+// Return every square the pawns could attack while advancing
+func PawnAttackSpans(pawns uint64, color uint) uint64 {
+	span := PawnFrontSpans(pawns, color)
+	return (span & ^FILE_A)>>1 | (span & ^FILE_H)<<1
+}
+
+// Return pawns with no enemy pawns in front of them on the same or adjacent
+// files. Only the most advanced of doubled pawns is considered passed
+func PassedPawns(pawns, oppPawns uint64, color uint) uint64 {
+	opp := 1 ^ color
+	stoppers := PawnFrontSpans(oppPawns, opp) | PawnAttackSpans(oppPawns, opp)
+	return pawns & ^stoppers & ^PawnFrontSpans(pawns, 1^color)
+}
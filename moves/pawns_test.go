@@ -0,0 +1,144 @@
+package moves
+
+import (
+	"github.com/j1642/chess-engine-2/board"
+	"testing"
+)
+
+func TestPawnPushes(t *testing.T) {
+	// White pawns on a2, b2, h4. Black pawns on b3, c7, d7. b2, b3 and d7 are blocked
+	cb, err := board.FromFen("8/2pp4/3n4/8/7P/1p6/PP6/8 w - - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty := ^(cb.Pieces[0] | cb.Pieces[1])
+
+	tests := []bbTestCase{
+		{
+			expected: uint64(1<<16 + 1<<39),
+			actual:   PawnSinglePushes(cb.Pawns[1], empty, 1),
+			name:     "white single pushes",
+		},
+		{
+			expected: uint64(1 << 24),
+			actual:   PawnDoublePushes(cb.Pawns[1], empty, 1),
+			name:     "white double pushes",
+		},
+		{
+			expected: uint64(1 << 42),
+			actual:   PawnSinglePushes(cb.Pawns[0], empty, 0),
+			name:     "black single pushes",
+		},
+		{
+			expected: uint64(1 << 34),
+			actual:   PawnDoublePushes(cb.Pawns[0], empty, 0),
+			name:     "black double pushes",
+		},
+		{
+			expected: uint64(1 << 9),
+			actual:   BlockedPawns(cb.Pawns[1], ^empty, 1),
+			name:     "white blocked pawns",
+		},
+		{
+			expected: uint64(1<<51 + 1<<17),
+			actual:   BlockedPawns(cb.Pawns[0], ^empty, 0),
+			name:     "black blocked pawns",
+		},
+	}
+
+	runMoveBBTests(t, tests)
+}
+
+func TestPawnAttacks(t *testing.T) {
+	tests := []bbTestCase{
+		{
+			// Pawns on the A and H files do not wrap around the board
+			square:   8,
+			expected: uint64(1<<17 + 1<<22),
+			actual:   PawnAttacks(uint64(1<<8+1<<15), 1),
+			name:     "white edge pawns",
+		},
+		{
+			square:   48,
+			expected: uint64(1<<41 + 1<<46),
+			actual:   PawnAttacks(uint64(1<<48+1<<55), 0),
+			name:     "black edge pawns",
+		},
+		{
+			square:   28,
+			expected: uint64(1 << 35),
+			actual:   PawnWestAttacks(uint64(1<<28), 1),
+			name:     "white west attack",
+		},
+		{
+			square:   28,
+			expected: uint64(1 << 21),
+			actual:   PawnEastAttacks(uint64(1<<28), 0),
+			name:     "black east attack",
+		},
+		{
+			// Pawns on e5 and g5 can capture on f6, the pawn on a5 cannot
+			square:   45,
+			expected: uint64(1<<36 + 1<<38),
+			actual:   PawnEpCapturers(uint64(1<<32+1<<36+1<<38), 45, 1),
+			name:     "white e.p. capturers",
+		},
+		{
+			square:   100,
+			expected: uint64(0),
+			actual:   PawnEpCapturers(uint64(1<<32+1<<36+1<<38), 100, 1),
+			name:     "no e.p. square",
+		},
+	}
+
+	runMoveBBTests(t, tests)
+}
+
+func TestPawnSpans(t *testing.T) {
+	tests := []bbTestCase{
+		{
+			square:   12,
+			expected: FILE_A<<4 & ^uint64(1<<4+1<<12),
+			actual:   PawnFrontSpans(uint64(1<<12), 1),
+			name:     "white front span",
+		},
+		{
+			square:   52,
+			expected: uint64(1<<4 + 1<<12 + 1<<20 + 1<<28 + 1<<36 + 1<<44),
+			actual:   PawnFrontSpans(uint64(1<<52), 0),
+			name:     "black front span",
+		},
+		{
+			square:   8,
+			expected: FILE_A<<1 & ^uint64(1<<1+1<<9),
+			actual:   PawnAttackSpans(uint64(1<<8), 1),
+			name:     "white attack span",
+		},
+	}
+
+	runMoveBBTests(t, tests)
+}
+
+func TestPassedPawns(t *testing.T) {
+	// White a5 and black c3 are passed, white d4 and black e6 stop each other,
+	// and only the front pawn of the doubled white g pawns is passed
+	cb, err := board.FromFen("8/8/4p3/P7/3P4/2p3P1/6P1/8 w - - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []bbTestCase{
+		{
+			expected: uint64(1<<32 + 1<<22),
+			actual:   PassedPawns(cb.Pawns[1], cb.Pawns[0], 1),
+			name:     "white passed pawns",
+		},
+		{
+			expected: uint64(1 << 18),
+			actual:   PassedPawns(cb.Pawns[0], cb.Pawns[1], 0),
+			name:     "black passed pawns",
+		},
+	}
+
+	runMoveBBTests(t, tests)
+}
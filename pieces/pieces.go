@@ -2,14 +2,12 @@
 package pieces
 
 import (
-	"bufio"
 	"fmt"
 	"github.com/j1642/chess-engine-2/board"
 	"github.com/j1642/chess-engine-2/moves"
 	"log"
+	"math"
 	"math/bits"
-	"os"
-	"strings"
 )
 
 /*
@@ -32,6 +30,11 @@ const (
 func MovePiece(move board.Move, cb *board.Board) {
 	fromBB := uint64(1 << move.From)
 	toBB := uint64(1 << move.To)
+	// Reset by captures and pawn moves. Stop at the largest uint8 rather than
+	// wrap to 0 and forget a fifty-move draw
+	if cb.HalfMoves < math.MaxUint8 {
+		cb.HalfMoves++
+	}
 	if cb.EpSquare != 100 {
 		cb.Zobrist ^= board.ZobristKeys.EpFile[cb.EpSquare%8]
 	}
@@ -71,7 +74,7 @@ func MovePiece(move board.Move, cb *board.Board) {
 			cb.Zobrist ^= board.ZobristKeys.ColorPieceSq[cb.WToMove][0][move.To]
 		}
 		cb.Zobrist ^= board.ZobristKeys.ColorPieceSq[cb.WToMove][0][move.From]
-		cb.HalfMoves = 1
+		cb.HalfMoves = 0
 	case KNIGHT:
 		cb.Knights[cb.WToMove] ^= fromBB + toBB
 		cb.EpSquare = 100
@@ -151,13 +154,12 @@ func MovePiece(move board.Move, cb *board.Board) {
 	cb.PrevMove = move
 	cb.WToMove ^= 1
 	cb.Zobrist ^= board.ZobristKeys.BToMove
-	cb.HalfMoves += 1
 }
 
 func capturePiece(squareBB uint64, square int8, cb *board.Board) {
 	opponent := 1 ^ cb.WToMove
 	cb.Pieces[opponent] ^= squareBB
-	cb.HalfMoves = 1
+	cb.HalfMoves = 0
 	var capturedMaterial int
 	var capturedType int
 
@@ -226,40 +228,27 @@ func capturePiece(squareBB uint64, square int8, cb *board.Board) {
 	}
 }
 
-func promotePawn(toBB uint64, square int8, cb *board.Board, promoteTo ...uint8) {
+func promotePawn(toBB uint64, square int8, cb *board.Board, promoteTo uint8) {
 	var promoteValue int
-	if len(promoteTo) == 1 {
-		switch {
-		case promoteTo[0] == QUEEN:
-			cb.Queens[cb.WToMove] ^= toBB
-			cb.Zobrist ^= board.ZobristKeys.ColorPieceSq[cb.WToMove][4][square]
-			promoteValue = 800 // 900 (queen) - 100 (pawn)
-		case promoteTo[0] == KNIGHT:
-			cb.Knights[cb.WToMove] ^= toBB
-			cb.Zobrist ^= board.ZobristKeys.ColorPieceSq[cb.WToMove][1][square]
-			promoteValue = 200
-		case promoteTo[0] == BISHOP:
-			cb.Bishops[cb.WToMove] ^= toBB
-			cb.Zobrist ^= board.ZobristKeys.ColorPieceSq[cb.WToMove][2][square]
-			promoteValue = 210
-		case promoteTo[0] == ROOK:
-			cb.Rooks[cb.WToMove] ^= toBB
-			cb.Zobrist ^= board.ZobristKeys.ColorPieceSq[cb.WToMove][3][square]
-			promoteValue = 400
-		default:
-			panic("invalid promoteTo")
-		}
-	} else {
-		fmt.Print("promote pawn to N, B, R, or Q: ")
-		userPromote := getUserInput()
-
-		if userPromote == QUEEN || userPromote == KNIGHT || userPromote == BISHOP ||
-			userPromote == ROOK {
-			promotePawn(toBB, square, cb, userPromote)
-		} else {
-			fmt.Println("invalid promotion type, try again")
-			promotePawn(toBB, square, cb)
-		}
+	switch promoteTo {
+	case QUEEN:
+		cb.Queens[cb.WToMove] ^= toBB
+		cb.Zobrist ^= board.ZobristKeys.ColorPieceSq[cb.WToMove][4][square]
+		promoteValue = 800 // 900 (queen) - 100 (pawn)
+	case KNIGHT:
+		cb.Knights[cb.WToMove] ^= toBB
+		cb.Zobrist ^= board.ZobristKeys.ColorPieceSq[cb.WToMove][1][square]
+		promoteValue = 200
+	case BISHOP:
+		cb.Bishops[cb.WToMove] ^= toBB
+		cb.Zobrist ^= board.ZobristKeys.ColorPieceSq[cb.WToMove][2][square]
+		promoteValue = 210
+	case ROOK:
+		cb.Rooks[cb.WToMove] ^= toBB
+		cb.Zobrist ^= board.ZobristKeys.ColorPieceSq[cb.WToMove][3][square]
+		promoteValue = 400
+	default:
+		panic("invalid promoteTo")
 	}
 
 	if cb.WToMove == 1 {
@@ -270,29 +259,90 @@ func promotePawn(toBB uint64, square int8, cb *board.Board, promoteTo ...uint8)
 	cb.Pawns[cb.WToMove] ^= toBB
 }
 
-func getUserInput() uint8 {
-	scanner := bufio.NewScanner(os.Stdin)
-	scanner.Scan()
-	err := scanner.Err()
-	if err != nil {
-		log.Println("failed to get input:", err)
-		return getUserInput()
-	}
-
-	var piece uint8
-	switch strings.ToLower(scanner.Text())[0] {
-	case byte('n'):
-		piece = KNIGHT
-	case byte('b'):
-		piece = BISHOP
-	case byte('r'):
-		piece = ROOK
-	case byte('q'):
-		piece = QUEEN
-	default:
-		return getUserInput()
+// Make a user-submitted move after checking that it is legal. An illegal move
+// returns an error and leaves the board unchanged. Use MovePiece() for moves
+// which are known to be legal, such as those from GetAllMoves()
+func TryMovePiece(move board.Move, cb *board.Board) error {
+	if move.From < 0 || move.From > 63 || move.To < 0 || move.To > 63 {
+		return fmt.Errorf("square out of range: from=%d, to=%d", move.From, move.To)
+	}
+	if move.Piece == PAWN && (move.To < 8 || move.To > 55) {
+		if move.PromoteTo != QUEEN && move.PromoteTo != ROOK &&
+			move.PromoteTo != BISHOP && move.PromoteTo != KNIGHT {
+			return fmt.Errorf("invalid promotion piece %d for move %v", move.PromoteTo, move)
+		}
+	} else if move.PromoteTo != NO_PIECE {
+		return fmt.Errorf("move %v is not a promotion", move)
+	}
+
+	for _, legalMove := range GetLegalMoves(cb) {
+		if legalMove == move {
+			MovePiece(move, cb)
+			return nil
+		}
+	}
+	return fmt.Errorf("illegal move %v", move)
+}
+
+// Return all strictly legal moves for color cb.WToMove
+func GetLegalMoves(cb *board.Board) []board.Move {
+	pseudoLegal := GetAllMoves(cb)
+	legalMoves := make([]board.Move, 0, len(pseudoLegal))
+	pos := board.StorePosition(cb)
+	_, checks := GetCheckingSquares(cb)
+	pinned := GetPinnedPieces(cb)
+	kSquare := cb.KingSqs[cb.WToMove]
+
+	for _, move := range pseudoLegal {
+		// King moves are strictly legal already. Out of check, other moves are
+		// only illegal when a pinned piece leaves the line to its king. En
+		// passant removes two pieces from a line, so it is played out
+		isEp := move.Piece == PAWN && move.To == cb.EpSquare
+		if move.Piece == KING {
+			legalMoves = append(legalMoves, move)
+			continue
+		}
+		if checks == 0 && !isEp {
+			if pinned&uint64(1<<move.From) == 0 || moves.Line[kSquare][move.From]&uint64(1<<move.To) != 0 {
+				legalMoves = append(legalMoves, move)
+			}
+			continue
+		}
+
+		MovePiece(move, cb)
+		if cb.Kings[1^cb.WToMove]&GetAttackedSquares(cb) == 0 {
+			legalMoves = append(legalMoves, move)
+		}
+		board.RestorePosition(pos, cb)
+	}
+
+	return legalMoves
+}
+
+// Return the pieces of the side to move which are pinned to their king
+func GetPinnedPieces(cb *board.Board) uint64 {
+	opponent := 1 ^ cb.WToMove
+	kSquare := cb.KingSqs[cb.WToMove]
+	occupied := cb.Pieces[0] | cb.Pieces[1]
+	// Sliding directions are ordered clockwise from north
+	orthogonal := moves.Sliding[0][kSquare] | moves.Sliding[2][kSquare] |
+		moves.Sliding[4][kSquare] | moves.Sliding[6][kSquare]
+	diagonal := moves.Sliding[1][kSquare] | moves.Sliding[3][kSquare] |
+		moves.Sliding[5][kSquare] | moves.Sliding[7][kSquare]
+	// Sliders which would attack the king on an empty board
+	snipers := orthogonal&(cb.Rooks[opponent]|cb.Queens[opponent]) |
+		diagonal&(cb.Bishops[opponent]|cb.Queens[opponent])
+
+	pinned := uint64(0)
+	for snipers > 0 {
+		blockers := moves.Between[kSquare][bits.TrailingZeros64(snipers)] & occupied
+		if bits.OnesCount64(blockers) == 1 && blockers&cb.Pieces[cb.WToMove] != 0 {
+			pinned |= blockers
+		}
+		snipers &= snipers - 1
 	}
-	return piece
+
+	return pinned
 }
 
 // Use for user-submitted moves only?
@@ -371,27 +421,73 @@ func GetPawnMoves(square int8, cb *board.Board) uint64 {
 		panic("pawns can't be on the first or last rank")
 	}
 
-	moves := moves.Pawn[cb.WToMove][square] & (cb.Pieces[opponent] | uint64(1<<cb.EpSquare))
+	pawn := uint64(1 << square)
+	empty := ^(cb.Pieces[0] | cb.Pieces[1])
+	pawnMoves := moves.PawnAttacks(pawn, cb.WToMove) & (cb.Pieces[opponent] | uint64(1<<cb.EpSquare))
+	pawnMoves |= moves.PawnSinglePushes(pawn, empty, cb.WToMove)
+	pawnMoves |= moves.PawnDoublePushes(pawn, empty, cb.WToMove)
 
-	var dir, low, high int8
-	if cb.WToMove == 1 {
-		dir = 8
-		low = 7
-		high = 16
-	} else {
-		dir = -8
-		low = 47
-		high = 56
+	return pawnMoves
+}
+
+// Append all pawn moves for color cb.WToMove, limited to target squares in
+// `targets`. Captures are always included. Pushes and en passant captures are
+// included when `includeQuiets` is true, so quiescence search skips en passant
+func appendPawnMoves(moveList []board.Move, targets uint64, includeQuiets bool, cb *board.Board) []board.Move {
+	color := cb.WToMove
+	pawns := cb.Pawns[color]
+	oppPieces := cb.Pieces[1^color]
+	empty := ^(cb.Pieces[0] | cb.Pieces[1])
+
+	moveList = appendPawnTargets(moveList, moves.PawnWestAttacks(pawns, color)&oppPieces&targets,
+		moves.PawnWestOffsets[color])
+	moveList = appendPawnTargets(moveList, moves.PawnEastAttacks(pawns, color)&oppPieces&targets,
+		moves.PawnEastOffsets[color])
+
+	if includeQuiets {
+		capturers := moves.PawnEpCapturers(pawns, cb.EpSquare, color)
+		if capturers != 0 {
+			// The captured pawn is not on the e.p. square, so it can also resolve a check
+			capturedBB := uint64(1 << (cb.EpSquare - moves.PawnPushOffsets[color]))
+			if (uint64(1<<cb.EpSquare)|capturedBB)&targets == 0 {
+				capturers = 0
+			}
+		}
+		for capturers > 0 {
+			fromSq := int8(bits.TrailingZeros64(capturers))
+			moveList = append(moveList, board.Move{From: fromSq, To: cb.EpSquare, Piece: PAWN, PromoteTo: NO_PIECE})
+			capturers &= capturers - 1
+		}
+
+		moveList = appendPawnTargets(moveList, moves.PawnSinglePushes(pawns, empty, color)&targets,
+			moves.PawnPushOffsets[color])
+		moveList = appendPawnTargets(moveList, moves.PawnDoublePushes(pawns, empty, color)&targets,
+			moves.PawnDoublePushOffsets[color])
 	}
-	occupied := cb.Pieces[0] | cb.Pieces[1]
 
-	if low < square && square < high && 1<<(square+dir)&occupied == 0 {
-		moves |= (1<<(square+dir) + 1<<(square+2*dir)) & ^occupied
-	} else {
-		moves |= 1 << (square + dir) & ^occupied
+	return moveList
+}
+
+// Append a pawn move to each square in `targets`, where every pawn moved by
+// the same offset. Moves to the first or eighth rank are expanded into promotions
+func appendPawnTargets(moveList []board.Move, targets uint64, offset int8) []board.Move {
+	var toSq int8
+	for targets > 0 {
+		toSq = int8(bits.TrailingZeros64(targets))
+		targets &= targets - 1
+		fromSq := toSq - offset
+
+		if 7 < toSq && toSq < 56 {
+			moveList = append(moveList, board.Move{From: fromSq, To: toSq, Piece: PAWN, PromoteTo: NO_PIECE})
+		} else {
+			moveList = append(moveList, board.Move{From: fromSq, To: toSq, Piece: PAWN, PromoteTo: QUEEN})
+			moveList = append(moveList, board.Move{From: fromSq, To: toSq, Piece: PAWN, PromoteTo: ROOK})
+			moveList = append(moveList, board.Move{From: fromSq, To: toSq, Piece: PAWN, PromoteTo: KNIGHT})
+			moveList = append(moveList, board.Move{From: fromSq, To: toSq, Piece: PAWN, PromoteTo: BISHOP})
+		}
 	}
 
-	return moves
+	return moveList
 }
 
 func getKnightMoves(square int8, cb *board.Board) uint64 {
@@ -443,12 +539,9 @@ func GetAttackedSquares(cb *board.Board) uint64 {
 	// TODO: Is there a way to avoid reading 1 bits when accumulating moves?
 	attackSquares := uint64(0)
 
-	bb := cb.Pawns[cb.WToMove]
-	for bb > 0 {
-		attackSquares |= moves.Pawn[cb.WToMove][bits.TrailingZeros64(bb)]
-		bb &= bb - 1
-	}
-	bb = cb.Knights[cb.WToMove]
+	attackSquares |= moves.PawnAttacks(cb.Pawns[cb.WToMove], cb.WToMove)
+
+	bb := cb.Knights[cb.WToMove]
 	for bb > 0 {
 		attackSquares |= moves.Knight[bits.TrailingZeros64(bb)]
 		bb &= bb - 1
@@ -509,13 +602,21 @@ func GetAllMoves(cb *board.Board) []board.Move {
 		return allMoves
 	}
 
-	pieces := [5]uint64{cb.Pawns[cb.WToMove], cb.Knights[cb.WToMove],
-		cb.Bishops[cb.WToMove], cb.Rooks[cb.WToMove], cb.Queens[cb.WToMove],
+	// When in check, only captures of the checking piece and blocks are allowed
+	targets := ^uint64(0)
+	if capturesBlks != 0 {
+		targets = capturesBlks
+	}
+	allMoves = appendPawnMoves(allMoves, targets, true, cb)
+
+	pieces := [4]uint64{cb.Knights[cb.WToMove], cb.Bishops[cb.WToMove],
+		cb.Rooks[cb.WToMove], cb.Queens[cb.WToMove],
 	}
-	moveFuncs := [5]moveGenFunc{GetPawnMoves, getKnightMoves, lookupBishopMoves,
+	moveFuncs := [4]moveGenFunc{getKnightMoves, lookupBishopMoves,
 		lookupRookMoves, getQueenMoves,
 	}
-	symbols := [5]uint8{PAWN, KNIGHT, BISHOP, ROOK, QUEEN}
+	symbols := [4]uint8{KNIGHT, BISHOP, ROOK, QUEEN}
+	targets &= ^cb.Pieces[cb.WToMove]
 
 	// 29% perft() speed up and -40% malloc from having this loop in this function
 	var fromSq int8
@@ -524,21 +625,11 @@ func GetAllMoves(cb *board.Board) []board.Move {
 			fromSq = int8(bits.TrailingZeros64(pieceBB))
 			pieceBB &= pieceBB - 1
 
-			movesBB := moveFuncs[i](fromSq, cb) & ^cb.Pieces[cb.WToMove]
+			movesBB := moveFuncs[i](fromSq, cb) & targets
 			for movesBB > 0 {
 				toSq = int8(bits.TrailingZeros64(movesBB))
 				movesBB &= movesBB - 1
-
-				if capturesBlks == 0 || uint64(1<<toSq)&capturesBlks != 0 {
-					if i != 0 || (7 < toSq && toSq < 56) {
-						allMoves = append(allMoves, board.Move{From: fromSq, To: toSq, Piece: symbols[i], PromoteTo: NO_PIECE})
-					} else {
-						allMoves = append(allMoves, board.Move{From: fromSq, To: toSq, Piece: symbols[i], PromoteTo: QUEEN})
-						allMoves = append(allMoves, board.Move{From: fromSq, To: toSq, Piece: symbols[i], PromoteTo: ROOK})
-						allMoves = append(allMoves, board.Move{From: fromSq, To: toSq, Piece: symbols[i], PromoteTo: KNIGHT})
-						allMoves = append(allMoves, board.Move{From: fromSq, To: toSq, Piece: symbols[i], PromoteTo: BISHOP})
-					}
-				}
+				allMoves = append(allMoves, board.Move{From: fromSq, To: toSq, Piece: symbols[i], PromoteTo: NO_PIECE})
 			}
 		}
 	}
@@ -580,15 +671,19 @@ func GetAllCaptures(cb *board.Board) []board.Move {
 		return captures
 	}
 
-	pieces := [5]uint64{cb.Pawns[cb.WToMove], cb.Knights[cb.WToMove],
-		cb.Bishops[cb.WToMove], cb.Rooks[cb.WToMove], cb.Queens[cb.WToMove],
+	targets := cb.Pieces[cb.WToMove^1] ^ cb.Kings[cb.WToMove^1]
+	if capturesBlks != 0 {
+		targets &= capturesBlks
 	}
-	moveFuncs := [5]moveGenFunc{GetPawnMoves, getKnightMoves, lookupBishopMoves,
+	captures = appendPawnMoves(captures, targets, false, cb)
+
+	pieces := [4]uint64{cb.Knights[cb.WToMove], cb.Bishops[cb.WToMove],
+		cb.Rooks[cb.WToMove], cb.Queens[cb.WToMove],
+	}
+	moveFuncs := [4]moveGenFunc{getKnightMoves, lookupBishopMoves,
 		lookupRookMoves, getQueenMoves,
 	}
-	symbols := [5]uint8{PAWN, KNIGHT, BISHOP, ROOK, QUEEN}
-
-	opponentPiecesMinusKing := cb.Pieces[cb.WToMove^1] ^ cb.Kings[cb.WToMove^1]
+	symbols := [4]uint8{KNIGHT, BISHOP, ROOK, QUEEN}
 
 	var fromSq int8
 	for i, pieceBB := range pieces {
@@ -596,21 +691,11 @@ func GetAllCaptures(cb *board.Board) []board.Move {
 			fromSq = int8(bits.TrailingZeros64(pieceBB))
 			pieceBB &= pieceBB - 1
 
-			capturesBB := moveFuncs[i](fromSq, cb) & opponentPiecesMinusKing
+			capturesBB := moveFuncs[i](fromSq, cb) & targets
 			for capturesBB > 0 {
 				toSq = int8(bits.TrailingZeros64(capturesBB))
 				capturesBB &= capturesBB - 1
-
-				if capturesBlks == 0 || uint64(1<<toSq)&capturesBlks != 0 {
-					if i != 0 || (7 < toSq && toSq < 56) {
-						captures = append(captures, board.Move{From: fromSq, To: toSq, Piece: symbols[i], PromoteTo: NO_PIECE})
-					} else {
-						captures = append(captures, board.Move{From: fromSq, To: toSq, Piece: symbols[i], PromoteTo: QUEEN})
-						captures = append(captures, board.Move{From: fromSq, To: toSq, Piece: symbols[i], PromoteTo: ROOK})
-						captures = append(captures, board.Move{From: fromSq, To: toSq, Piece: symbols[i], PromoteTo: KNIGHT})
-						captures = append(captures, board.Move{From: fromSq, To: toSq, Piece: symbols[i], PromoteTo: BISHOP})
-					}
-				}
+				captures = append(captures, board.Move{From: fromSq, To: toSq, Piece: symbols[i], PromoteTo: NO_PIECE})
 			}
 		}
 	}
@@ -667,61 +752,14 @@ func GetCheckingSquares(cb *board.Board) (uint64, int) {
 					panic(panicMsgs[i])
 				}
 			}
-			dir := findDirection(cb.KingSqs[cb.WToMove], attackerSquares[0])
-			attackers[i] = fillFromTo(cb.KingSqs[cb.WToMove], attackerSquares[0], dir)
+			attackers[i] = moves.Between[kSquare][attackerSquares[0]] |
+				uint64(1<<attackerSquares[0])
 		}
 	}
 
 	return pAttackers | knightAttackers | attackers[0] | attackers[1], attackerCount
 }
 
-// Return a bitboard of squares between `from and `to`, excluding `from`
-// and including `to`
-func fillFromTo(from, to, direction int8) uint64 {
-	bb := uint64(0)
-	for sq := from + direction; sq != to; sq += direction {
-		bb += 1 << sq
-	}
-	bb += 1 << to
-
-	return bb
-}
-
-// Return the direction from one square to another. Assumes (from, to) is an
-// orthogonal or diagonal move
-func findDirection(from, to int8) int8 {
-	var dir int8
-	diff := to - from
-	// TODO: Change to lookup table for files, or use bitboards.
-	files := board.GetFiles()
-
-	switch {
-	case diff%8 == 0:
-		dir = 8
-	case diff%9 == 0:
-		dir = 9
-	case -6 <= diff && diff <= 6:
-		dir = 1
-	case diff%7 == 0:
-		fromInAFile := board.ContainsN(from, files[0])
-		fromInHFile := board.ContainsN(from, files[3])
-		toInAFile := board.ContainsN(to, files[0])
-		toInHFile := board.ContainsN(to, files[3])
-		if (fromInAFile && toInHFile) || (fromInHFile && toInAFile) {
-			dir = 1
-		} else {
-			dir = 7
-		}
-	default:
-		panic("invalid toSquare-fromSquare difference")
-	}
-	if diff < 0 {
-		dir *= -1
-	}
-
-	return dir
-}
-
 func read1Bits(bb uint64) []int8 {
 	// Using TrailingZeros64() seems as fast as bitshifting right while bb>0.
 	squares := make([]int8, 0, 4)
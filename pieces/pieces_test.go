@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/j1642/chess-engine-2/board"
 	"github.com/j1642/chess-engine-2/moves"
+	"slices"
 	"strings"
 	"testing"
 )
@@ -244,8 +245,39 @@ func TestMovePiece(t *testing.T) {
 	}
 }
 
+func TestHalfMoves(t *testing.T) {
+	cb := board.New()
+	moves := []struct {
+		move board.Move
+		want uint8
+	}{
+		{board.Move{From: 6, To: 21, Piece: KNIGHT, PromoteTo: NO_PIECE}, 1},
+		{board.Move{From: 62, To: 45, Piece: KNIGHT, PromoteTo: NO_PIECE}, 2},
+		// Pawn moves and captures reset the count
+		{board.Move{From: 12, To: 28, Piece: PAWN, PromoteTo: NO_PIECE}, 0},
+		{board.Move{From: 45, To: 28, Piece: KNIGHT, PromoteTo: NO_PIECE}, 0},
+		{board.Move{From: 1, To: 18, Piece: KNIGHT, PromoteTo: NO_PIECE}, 1},
+	}
+	for _, m := range moves {
+		MovePiece(m.move, cb)
+		if cb.HalfMoves != m.want {
+			t.Errorf("after %v: want HalfMoves=%d, got %d", m.move, m.want, cb.HalfMoves)
+		}
+	}
+}
+
+func TestHalfMovesDoNotWrap(t *testing.T) {
+	cb, err := board.FromFen("4k3/8/8/8/8/8/8/4K3 w - - 255 200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	MovePiece(board.Move{From: 4, To: 5, Piece: KING, PromoteTo: NO_PIECE}, cb)
+	if cb.HalfMoves != 255 {
+		t.Errorf("want HalfMoves=255, got %d", cb.HalfMoves)
+	}
+}
+
 func TestPromotePawn(t *testing.T) {
-	// TODO: mock user input to test other promotePawn() branch
 	cb := &board.Board{
 		WToMove: 1,
 		Pawns:   [2]uint64{1 << 1, 1 << 63},
@@ -261,6 +293,142 @@ func TestPromotePawn(t *testing.T) {
 	}
 }
 
+func TestTryMovePiece(t *testing.T) {
+	fen := "r3k3/1P6/8/8/8/8/8/R3K2r w Qq - 0 1"
+	illegalMoves := []board.Move{
+		// Promotion piece is missing or invalid
+		{From: 49, To: 57, Piece: PAWN, PromoteTo: NO_PIECE},
+		{From: 49, To: 57, Piece: PAWN, PromoteTo: KING},
+		// Not a promotion
+		{From: 0, To: 8, Piece: ROOK, PromoteTo: QUEEN},
+		// Wrong piece type for the from square
+		{From: 0, To: 8, Piece: QUEEN, PromoteTo: NO_PIECE},
+		// King is in check, so castling and most other moves are illegal
+		{From: 4, To: 2, Piece: KING, PromoteTo: NO_PIECE},
+		{From: 49, To: 57, Piece: PAWN, PromoteTo: QUEEN},
+		// Empty square, square out of range
+		{From: 20, To: 28, Piece: PAWN, PromoteTo: NO_PIECE},
+		{From: 0, To: 64, Piece: ROOK, PromoteTo: NO_PIECE},
+	}
+
+	for i, move := range illegalMoves {
+		cb, err := board.FromFen(fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		orig := *cb
+		if err = TryMovePiece(move, cb); err == nil {
+			t.Errorf("illegal move[%d] %v: want error, got nil", i, move)
+		}
+		if *cb != orig {
+			t.Errorf("illegal move[%d] %v changed the board", i, move)
+		}
+	}
+
+	cb, err := board.FromFen(fen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Escape check, then promote to a knight
+	if err = TryMovePiece(board.Move{From: 4, To: 11, Piece: KING, PromoteTo: NO_PIECE}, cb); err != nil {
+		t.Error(err)
+	}
+	MovePiece(board.Move{From: 60, To: 59, Piece: KING, PromoteTo: NO_PIECE}, cb)
+	if err = TryMovePiece(board.Move{From: 49, To: 57, Piece: PAWN, PromoteTo: KNIGHT}, cb); err != nil {
+		t.Error(err)
+	}
+	if cb.Knights[1] != uint64(1<<57) || cb.Pawns[1] != 0 {
+		t.Errorf("pawn did not promote to a knight: knights=%v, pawns=%v",
+			read1Bits(cb.Knights[1]), read1Bits(cb.Pawns[1]))
+	}
+}
+
+func TestGetLegalMoves(t *testing.T) {
+	// The e2 bishop is pinned to the king, so only king moves are legal
+	cb, err := board.FromFen("4r3/8/8/8/8/8/4B3/4K3 w - - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := *cb
+	tests := []allMovesTestCase{
+		{
+			expected: []board.Move{{From: 4, To: 3, Piece: KING, PromoteTo: NO_PIECE},
+				{From: 4, To: 5, Piece: KING, PromoteTo: NO_PIECE},
+				{From: 4, To: 11, Piece: KING, PromoteTo: NO_PIECE},
+				{From: 4, To: 13, Piece: KING, PromoteTo: NO_PIECE}},
+			actual: GetLegalMoves(cb),
+		},
+	}
+
+	runGetAllMovesTests(t, tests)
+	if *cb != orig {
+		t.Error("GetLegalMoves changed the board")
+	}
+}
+
+func TestGetPinnedPieces(t *testing.T) {
+	tests := []struct {
+		name, fen string
+		want      uint64
+	}{
+		{"file pin", "4r3/8/8/8/8/8/4B3/4K3 w - - 0 1", 1 << 12},
+		{"diagonal pin", "4k3/8/8/8/q7/8/2N5/3K4 w - - 0 1", 1 << 10},
+		{"two blockers", "4r3/8/8/8/4n3/8/4B3/4K3 w - - 0 1", 0},
+		{"opponent blocker", "4r3/8/8/8/8/8/4b3/4K3 w - - 0 1", 0},
+		{"bishop on a file", "4b3/8/8/8/8/8/4B3/4K3 w - - 0 1", 0},
+	}
+	for _, tt := range tests {
+		cb, err := board.FromFen(tt.fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := GetPinnedPieces(cb); got != tt.want {
+			t.Errorf("%s: want=%b, got=%b", tt.name, tt.want, got)
+		}
+	}
+}
+
+// Compare GetLegalMoves with playing out every pseudo-legal move
+func TestGetLegalMovesMatchesMakeMove(t *testing.T) {
+	fens := []string{
+		"r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1",
+		// En passant would expose the king along the fifth rank
+		"8/8/8/KPp4r/8/8/8/6k1 w - c6 0 1",
+		"8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1",
+	}
+	var walk func(cb *board.Board, depth int)
+	walk = func(cb *board.Board, depth int) {
+		pos := board.StorePosition(cb)
+		want := []board.Move{}
+		for _, move := range GetAllMoves(cb) {
+			MovePiece(move, cb)
+			if move.Piece == KING || cb.Kings[1^cb.WToMove]&GetAttackedSquares(cb) == 0 {
+				want = append(want, move)
+			}
+			board.RestorePosition(pos, cb)
+		}
+		got := GetLegalMoves(cb)
+		if !slices.Equal(got, want) {
+			t.Fatalf("want=%v, got=%v", want, got)
+		}
+		if depth == 1 {
+			return
+		}
+		for _, move := range got {
+			MovePiece(move, cb)
+			walk(cb, depth-1)
+			board.RestorePosition(pos, cb)
+		}
+	}
+	for _, fen := range fens {
+		cb, err := board.FromFen(fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		walk(cb, 3)
+	}
+}
+
 func TestGetAttackedSquare(t *testing.T) {
 	cb := board.New()
 
@@ -389,80 +557,6 @@ func runGetAllMovesTests(t *testing.T, tests []allMovesTestCase) {
 	}
 }
 
-func TestFillFromTo(t *testing.T) {
-	expected := uint64(1 << 8)
-	actual := fillFromTo(0, 8, 8)
-	if expected != actual {
-		t.Errorf("fillFromTo: want=[8], got=%v", read1Bits(actual))
-	}
-	expected = uint64(1<<8 + 1<<16)
-	actual = fillFromTo(0, 16, 8)
-	if expected != actual {
-		t.Errorf("fillFromTo: want=[8 16], got=%v", read1Bits(actual))
-	}
-	expected = uint64(1<<53 + 1<<46 + 1<<39)
-	actual = fillFromTo(60, 39, -7)
-	if expected != actual {
-		t.Errorf("fillFromTo: want=[39 46 53], got=%v", read1Bits(actual))
-	}
-}
-
-type intIntTestCase struct {
-	expected, actual int8
-}
-
-func TestFindDirection(t *testing.T) {
-	tests := []intIntTestCase{
-		// Roughly clockwise
-		{
-			expected: 8,
-			actual:   findDirection(9, 17),
-		},
-		{
-			expected: 9,
-			actual:   findDirection(9, 18),
-		},
-		{
-			expected: 1,
-			actual:   findDirection(9, 10),
-		},
-		{
-			expected: 1,
-			actual:   findDirection(0, 7),
-		},
-		{
-			expected: -1,
-			actual:   findDirection(7, 0),
-		},
-		{
-			expected: -7,
-			actual:   findDirection(9, 2),
-		},
-		{
-			expected: -8,
-			actual:   findDirection(9, 1),
-		},
-		{
-			expected: -9,
-			actual:   findDirection(9, 0),
-		},
-		{
-			expected: -1,
-			actual:   findDirection(9, 8),
-		},
-		{
-			expected: 7,
-			actual:   findDirection(9, 16),
-		},
-	}
-
-	for _, tt := range tests {
-		if tt.expected != tt.actual {
-			t.Errorf("findDirection: want=%d, got=%d", tt.expected, tt.actual)
-		}
-	}
-}
-
 type checkingSquaresCase struct {
 	cb                            *board.Board
 	expCapsBlks, actualCapsBlks   uint64
@@ -525,6 +619,35 @@ func runGetCheckingSquaresTests(t *testing.T, tests []checkingSquaresCase) {
 	}
 }
 
+func TestPawnMovesWithoutEpSquare(t *testing.T) {
+	tests := []struct {
+		fen  string
+		want []board.Move
+	}{
+		{"4k3/8/8/8/8/8/4P3/4K3 w - - 0 1", []board.Move{
+			{From: 12, To: 20, Piece: PAWN, PromoteTo: NO_PIECE},
+			{From: 12, To: 28, Piece: PAWN, PromoteTo: NO_PIECE}}},
+		{"4k3/4p3/8/8/8/8/8/4K3 b - - 0 1", []board.Move{
+			{From: 52, To: 44, Piece: PAWN, PromoteTo: NO_PIECE},
+			{From: 52, To: 36, Piece: PAWN, PromoteTo: NO_PIECE}}},
+	}
+	for _, tt := range tests {
+		cb, err := board.FromFen(tt.fen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pawnMoves := []board.Move{}
+		for _, move := range GetAllMoves(cb) {
+			if move.Piece == PAWN {
+				pawnMoves = append(pawnMoves, move)
+			}
+		}
+		if !slices.Equal(pawnMoves, tt.want) {
+			t.Errorf("%q: want=%v, got=%v", tt.fen, tt.want, pawnMoves)
+		}
+	}
+}
+
 func TestGetAllMoves(t *testing.T) {
 	cb, err := board.FromFen("R5rR/8/8/8/8/8/8/RNBQ2K1 w - - 0 1")
 	if err != nil {
@@ -594,6 +717,24 @@ func TestGetAllMoves(t *testing.T) {
 		actual: GetAllMoves(cb4),
 	})
 
+	cb5, err := board.FromFen("8/8/8/2k5/3Pp3/8/8/4K3 b - d3 0 1")
+	if err != nil {
+		t.Error(err)
+	}
+	tests = append(tests, allMovesTestCase{
+		// En passant capture of the checking pawn.
+		expected: []board.Move{{From: 34, To: 25, Piece: KING, PromoteTo: NO_PIECE},
+			{From: 34, To: 26, Piece: KING, PromoteTo: NO_PIECE},
+			{From: 34, To: 27, Piece: KING, PromoteTo: NO_PIECE},
+			{From: 34, To: 33, Piece: KING, PromoteTo: NO_PIECE},
+			{From: 34, To: 35, Piece: KING, PromoteTo: NO_PIECE},
+			{From: 34, To: 41, Piece: KING, PromoteTo: NO_PIECE},
+			{From: 34, To: 42, Piece: KING, PromoteTo: NO_PIECE},
+			{From: 34, To: 43, Piece: KING, PromoteTo: NO_PIECE},
+			{From: 28, To: 19, Piece: PAWN, PromoteTo: NO_PIECE}},
+		actual: GetAllMoves(cb5),
+	})
+
 	runGetAllMovesTests(t, tests)
 }
 
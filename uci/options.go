@@ -0,0 +1,117 @@
+package uci
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// UCI option types. The combo and string types are left out until an engine
+// setting needs them
+const (
+	SPIN = iota
+	CHECK
+	BUTTON
+)
+
+var optionTypeNames = [3]string{"spin", "check", "button"}
+
+// An engine setting which the GUI can change with setoption
+type option struct {
+	name     string
+	kind     int
+	def      string
+	min, max int // spin only
+	value    string
+	// Validate a new value and pass it to the engine. Returns the value as stored
+	set func(value string) (string, error)
+}
+
+// A spin option holds an integer. Values outside [min, max] are clamped
+func spinOption(name string, def, minValue, maxValue int, onChange func(int)) *option {
+	return &option{
+		name: name, kind: SPIN, def: strconv.Itoa(def), min: minValue, max: maxValue,
+		set: func(value string) (string, error) {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return "", err
+			}
+			n = max(minValue, min(n, maxValue))
+			onChange(n)
+			return strconv.Itoa(n), nil
+		},
+	}
+}
+
+// A check option holds true or false
+func checkOption(name string, def bool, onChange func(bool)) *option {
+	return &option{
+		name: name, kind: CHECK, def: strconv.FormatBool(def),
+		set: func(value string) (string, error) {
+			value = strings.ToLower(value)
+			if value != "true" && value != "false" {
+				return "", fmt.Errorf("want true or false, got %q", value)
+			}
+			onChange(value == "true")
+			return value, nil
+		},
+	}
+}
+
+// A button option has no value. Setting it calls onPress
+func buttonOption(name string, onPress func()) *option {
+	return &option{
+		name: name, kind: BUTTON,
+		set: func(string) (string, error) {
+			onPress()
+			return "", nil
+		},
+	}
+}
+
+// Return the option as it is advertised after the uci command
+func (o *option) String() string {
+	var line strings.Builder
+	fmt.Fprintf(&line, "option name %s type %s", o.name, optionTypeNames[o.kind])
+	switch o.kind {
+	case SPIN:
+		fmt.Fprintf(&line, " default %s min %d max %d", o.def, o.min, o.max)
+	case CHECK:
+		fmt.Fprintf(&line, " default %s", o.def)
+	}
+	return line.String()
+}
+
+// Options in the order they are advertised
+type optionRegistry struct {
+	options []*option
+}
+
+func (r *optionRegistry) add(o *option) {
+	o.value = o.def
+	r.options = append(r.options, o)
+}
+
+// Return the option with the given name, ignoring case, or nil
+func (r *optionRegistry) lookup(name string) *option {
+	for _, o := range r.options {
+		if strings.EqualFold(o.name, name) {
+			return o
+		}
+	}
+	return nil
+}
+
+// Change an option's value and notify the engine
+func (r *optionRegistry) set(name, value string) error {
+	o := r.lookup(name)
+	if o == nil {
+		return fmt.Errorf("no such option: %s", name)
+	}
+	stored, err := o.set(value)
+	if err != nil {
+		return fmt.Errorf("option %s: %w", o.name, err)
+	}
+	o.value = stored
+	return nil
+}
@@ -0,0 +1,126 @@
+package uci
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+type optionStringTestCase struct {
+	option   *option
+	expected string
+}
+
+func TestOptionString(t *testing.T) {
+	tests := []optionStringTestCase{
+		{
+			option:   spinOption("Hash", 16, 1, 32768, func(int) {}),
+			expected: "option name Hash type spin default 16 min 1 max 32768",
+		},
+		{
+			option:   checkOption("Ponder", false, func(bool) {}),
+			expected: "option name Ponder type check default false",
+		},
+		{
+			option:   buttonOption("Clear Hash", func() {}),
+			expected: "option name Clear Hash type button",
+		},
+	}
+	for _, tt := range tests {
+		if actual := tt.option.String(); actual != tt.expected {
+			t.Errorf("want=%q, got=%q", tt.expected, actual)
+		}
+	}
+}
+
+type optionSetTestCase struct {
+	name, value string
+	ok          bool
+	stored      string
+}
+
+func TestOptionRegistrySet(t *testing.T) {
+	var spin int
+	var check bool
+	presses := 0
+	r := optionRegistry{}
+	r.add(spinOption("Move Overhead", 10, 0, 5000, func(n int) { spin = n }))
+	r.add(checkOption("Ponder", false, func(b bool) { check = b }))
+	r.add(buttonOption("Clear Hash", func() { presses++ }))
+
+	tests := []optionSetTestCase{
+		{name: "Move Overhead", value: "100", ok: true, stored: "100"},
+		// Names are not case sensitive, and spin values are clamped
+		{name: "move overhead", value: "9999", ok: true, stored: "5000"},
+		{name: "Move Overhead", value: "-1", ok: true, stored: "0"},
+		{name: "Move Overhead", value: "ten", stored: "0"},
+		{name: "Ponder", value: "true", ok: true, stored: "true"},
+		{name: "Ponder", value: "yes", stored: "true"},
+		{name: "Clear Hash", ok: true},
+		{name: "No Such Option", value: "1"},
+	}
+	for _, tt := range tests {
+		err := r.set(tt.name, tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("set %q %q: want ok=%v, got err=%v", tt.name, tt.value, tt.ok, err)
+		}
+		if o := r.lookup(tt.name); o != nil && o.value != tt.stored {
+			t.Errorf("set %q %q: want value=%q, got=%q", tt.name, tt.value, tt.stored, o.value)
+		}
+	}
+
+	// Callbacks received the last valid values
+	if spin != 0 || !check || presses != 1 {
+		t.Errorf("callbacks: got spin=%d check=%v presses=%d", spin, check, presses)
+	}
+}
+
+func TestSetOptionCommand(t *testing.T) {
+	var out strings.Builder
+	s := NewSession(strings.NewReader(""), &out)
+	// Multi-word names and values
+	s.ProcessMessage("setoption name Move Overhead value 250")
+	s.ProcessMessage("setoption name Threads value 4")
+	s.ProcessMessage("setoption name Clear Hash")
+	if o := s.options.lookup("Move Overhead"); o.value != "250" {
+		t.Errorf("Move Overhead: want=250, got=%s", o.value)
+	}
+	if o := s.options.lookup("Threads"); o.value != "4" {
+		t.Errorf("Threads: want=4, got=%s", o.value)
+	}
+}
+
+func TestSetOptionDuringSearch(t *testing.T) {
+	var out bytes.Buffer
+	s := NewSession(strings.NewReader(""), &out)
+	s.ProcessMessage("position startpos")
+	s.ProcessMessage("go infinite")
+	s.ProcessMessage("setoption name MultiPV value 2")
+	s.ProcessMessage("setoption name Clear Hash")
+	time.Sleep(50 * time.Millisecond)
+	// The GUI did not stop the search, so it must not see a bestmove
+	if strings.Contains(s.output(&out), "bestmove") {
+		t.Error("bestmove before stop")
+	}
+	if o := s.options.lookup("MultiPV"); o.value != "1" {
+		t.Errorf("MultiPV during the search: want=1, got=%s", o.value)
+	}
+	s.ProcessMessage("stop")
+	if got := strings.Count(s.output(&out), "bestmove"); got != 1 {
+		t.Errorf("want one bestmove after stop, got %d", got)
+	}
+	if o := s.options.lookup("MultiPV"); o.value != "2" {
+		t.Errorf("MultiPV after stop: want=2, got=%s", o.value)
+	}
+
+	// An option set during a search which ends by itself applies at the
+	// next command
+	s.ProcessMessage("go depth 1")
+	s.ProcessMessage("setoption name MultiPV value 3")
+	s.searches.wait()
+	s.ProcessMessage("isready")
+	if o := s.options.lookup("MultiPV"); o.value != "3" {
+		t.Errorf("MultiPV after the search ended: want=3, got=%s", o.value)
+	}
+}
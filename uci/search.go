@@ -0,0 +1,57 @@
+package uci
+
+// Runs at most one search at a time in a background goroutine
+type searchManager struct {
+	stop chan bool
+	// Closed when the running search has printed its bestmove
+	done chan struct{}
+}
+
+// Stop any running search, then call search in the background. The search
+// must return soon after it receives a value from stop
+func (m *searchManager) start(search func(stop chan bool)) {
+	m.stopAndWait()
+	stop := make(chan bool, 1)
+	done := make(chan struct{})
+	m.stop, m.done = stop, done
+	go func() {
+		defer close(done)
+		search(stop)
+	}()
+}
+
+// Stop the running search and wait until it has printed its bestmove. Does
+// nothing if no search is running
+func (m *searchManager) stopAndWait() {
+	if m.done == nil {
+		return
+	}
+	select {
+	case m.stop <- true:
+	default:
+		// The search was already told to stop
+	}
+	<-m.done
+	m.stop, m.done = nil, nil
+}
+
+// Wait for the running search to finish without stopping it
+func (m *searchManager) wait() {
+	if m.done != nil {
+		<-m.done
+		m.stop, m.done = nil, nil
+	}
+}
+
+// Return true if a search is running
+func (m *searchManager) running() bool {
+	if m.done == nil {
+		return false
+	}
+	select {
+	case <-m.done:
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,64 @@
+package uci
+
+import (
+	"testing"
+	"time"
+)
+
+// A search which runs until it is stopped, then records its result
+func blockingSearch(results chan<- string, result string) func(chan bool) {
+	return func(stop chan bool) {
+		<-stop
+		results <- result
+	}
+}
+
+func TestSearchManagerStop(t *testing.T) {
+	m := searchManager{}
+	// Stopping without a search does nothing
+	m.stopAndWait()
+
+	results := make(chan string, 2)
+	m.start(blockingSearch(results, "bestmove"))
+	if !m.running() {
+		t.Fatal("search is not running after start")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		m.stopAndWait()
+		// A second stop does nothing
+		m.stopAndWait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stop did not end the search")
+	}
+	if m.running() {
+		t.Error("search is running after stop")
+	}
+	if len(results) != 1 {
+		t.Errorf("results: want exactly 1, got %d", len(results))
+	}
+}
+
+func TestSearchManagerRestart(t *testing.T) {
+	m := searchManager{}
+	results := make(chan string, 2)
+	m.start(blockingSearch(results, "first"))
+	first := m.done
+
+	// A new search stops the previous one before it starts
+	m.start(func(stop chan bool) { results <- "second" })
+	select {
+	case <-first:
+	default:
+		t.Error("the first search is still running")
+	}
+	m.wait()
+	if len(results) != 2 || <-results != "first" || <-results != "second" {
+		t.Error("want the first search to finish before the second")
+	}
+}
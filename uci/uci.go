@@ -2,67 +2,239 @@
 package uci
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
-	"log"
-	"os"
+	"io"
+	"math/bits"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/j1642/chess-engine-2/board"
 	"github.com/j1642/chess-engine-2/engine"
 	"github.com/j1642/chess-engine-2/pieces"
 )
 
-var currentPosition = board.New()
-var stop chan bool
+// A UCI session reads commands from a GUI and writes responses. Each session
+// owns an engine, so several sessions can run in one process
+type Session struct {
+	in  io.Reader
+	out io.Writer
+	// Serializes writes from the command loop and the search
+	outMu sync.Mutex
 
-// Receive a message from the chess GUI and return a response
-func ProcessMessage(s string) {
-	split := strings.Fields(s)
+	engine   *engine.Engine
+	options  optionRegistry
+	position *board.Board
+	// Zobrist hashes of the positions before position, oldest first
+	history  []uint64
+	searches searchManager
+	// Report a ponder move with bestmove
+	ponder bool
+	// Receives ponderhit while the running search ponders
+	ponderHit chan bool
+	// Report extra search statistics. Can change during a search
+	debug atomic.Bool
+	// setoption commands received during a search, applied once it ends
+	pendingOptions [][]string
+}
+
+func NewSession(in io.Reader, out io.Writer) *Session {
+	s := &Session{
+		in:       in,
+		out:      out,
+		engine:   engine.New(),
+		position: board.New(),
+	}
+	s.registerOptions()
+	return s
+}
+
+// Process commands until quit or the end of the input. A running search is
+// stopped before returning
+func (s *Session) Run() error {
+	scanner := bufio.NewScanner(s.in)
+	for scanner.Scan() {
+		if !s.ProcessMessage(scanner.Text()) {
+			return nil
+		}
+	}
+	s.searches.stopAndWait()
+	return scanner.Err()
+}
+
+// Write one line of output
+func (s *Session) printf(format string, a ...any) {
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	fmt.Fprintf(s.out, format+"\n", a...)
+}
+
+// Report an error to the GUI, one info string per line
+func (s *Session) printError(err error) {
+	for _, line := range strings.Split(err.Error(), "\n") {
+		s.printf("info string %s", line)
+	}
+}
+
+// Commands from the GUI. Other words before a command are ignored
+var commands = map[string]bool{
+	"uci": true, "debug": true, "isready": true, "setoption": true,
+	"register": true, "ucinewgame": true, "position": true, "go": true,
+	"stop": true, "ponderhit": true, "quit": true, "d": true,
+}
+
+// Receive a message from the chess GUI and respond. Return false after quit
+func (s *Session) ProcessMessage(msg string) bool {
+	split := strings.Fields(msg)
+	// Skip unknown leading tokens, as the UCI spec requires. A line without a
+	// command is ignored
+	for len(split) > 0 && !commands[split[0]] {
+		split = split[1:]
+	}
+	if len(split) == 0 {
+		return true
+	}
+	if len(s.pendingOptions) > 0 && !s.searches.running() {
+		// The search ended by itself
+		s.stopSearch()
+	}
 	switch split[0] {
 	case "uci":
-		fmt.Println("id name chess-engine-2")
-		fmt.Println("id author j1642")
-		// would send available options here is they existed
-		fmt.Println("uciok")
+		s.printf("id name chess-engine-2")
+		s.printf("id author j1642")
+		for _, o := range s.options.options {
+			s.printf("%s", o)
+		}
+		s.printf("uciok")
 	case "debug":
-		// TODO: "debug on" prints more info to the GUI. Can be sent while calculating. Off by default
+		// "debug on" reports search statistics. Can be sent while calculating
+		if len(split) > 1 && (split[1] == "on" || split[1] == "off") {
+			s.debug.Store(split[1] == "on")
+		}
 	case "isready":
 		// respond immediately if calculating, wait to send if doing something
 		// time-consuming like setting up tablebases
-		fmt.Println("readyok")
+		s.printf("readyok")
 	case "setoption":
-		// Change engine settings. No settings are implemented at the moment
+		// Options such as the hash size cannot change during a search, and
+		// stopping it would print a bestmove the GUI did not ask for
+		if s.searches.running() {
+			s.pendingOptions = append(s.pendingOptions, split)
+		} else {
+			s.stopSearch()
+			s.setOption(split)
+		}
 	case "register":
 		// This engine does not require a username or code to work
-		fmt.Println("registration ok")
+		s.printf("registration ok")
 	case "ucinewgame":
-		// Next position and search will be a different game. Ignore but maybe clear tTable?
+		// Next position and search will be a different game
+		s.stopSearch()
+		s.engine.NewGame()
 	case "position":
-		currentPosition = buildPosition(split)
+		cb, history, err := buildGame(split)
+		if err != nil {
+			s.printError(err)
+		}
+		if cb != nil {
+			s.position, s.history = cb, history
+		}
 	case "go":
-		go calculate(split)
+		s.calculate(split)
 	case "stop":
 		// Keep the best move and stop calculating
-		go func() {
-			stop <- true
-		}()
+		s.stopSearch()
 	case "ponderhit":
-		// Ignore because ponder is not implemented
+		// The opponent played the expected move. Continue the search on the clock
+		if s.ponderHit != nil {
+			s.ponderHit <- true
+			s.ponderHit = nil
+		}
 	case "quit":
-		// TODO: will all goroutines stop upon exiting
-		os.Exit(0)
+		s.searches.stopAndWait()
+		return false
 	case "d":
-		currentPosition.Print()
+		s.outMu.Lock()
+		s.position.Fprint(s.out)
+		s.outMu.Unlock()
 	default:
 	}
+	return true
+}
+
+// Stop the running search and wait for its bestmove, then apply the options
+// which were set during the search
+func (s *Session) stopSearch() {
+	s.searches.stopAndWait()
+	for _, split := range s.pendingOptions {
+		s.setOption(split)
+	}
+	s.pendingOptions = nil
+}
+
+// Change an engine setting. Input format: "setoption name <id> [value <x>]",
+// where the id and value may contain spaces
+func (s *Session) setOption(split []string) {
+	name, value := parseSetOption(split)
+	if err := s.options.set(name, value); err != nil {
+		s.printError(fmt.Errorf("setoption: %w", err))
+	}
+}
+
+// Register the options which the GUI may change
+func (s *Session) registerOptions() {
+	e := s.engine
+	s.options.add(spinOption("Hash", engine.DEFAULT_HASH_MB, engine.MIN_HASH_MB, engine.MAX_HASH_MB, e.SetHashSize))
+	s.options.add(buttonOption("Clear Hash", e.ClearHash))
+	s.options.add(spinOption("Threads", engine.DEFAULT_THREADS, 1, engine.MAX_THREADS, e.SetThreads))
+	s.options.add(spinOption("Move Overhead", engine.DEFAULT_MOVE_OVERHEAD, 0, engine.MAX_MOVE_OVERHEAD, e.SetMoveOverhead))
+	s.options.add(spinOption("MultiPV", engine.DEFAULT_MULTI_PV, 1, engine.MAX_MULTI_PV, e.SetMultiPV))
+	s.options.add(checkOption("Ponder", false, func(ponder bool) { s.ponder = ponder }))
+	s.options.add(spinOption("Contempt", engine.DEFAULT_CONTEMPT, -engine.MAX_CONTEMPT, engine.MAX_CONTEMPT, e.SetContempt))
+	s.options.add(checkOption("UCI_AnalyseMode", false, e.SetAnalysisMode))
+}
+
+// Return the option name and value from a setoption command
+func parseSetOption(split []string) (string, string) {
+	nameIdx, valueIdx := len(split), len(split)
+	for i, s := range split {
+		if s == "name" && nameIdx == len(split) {
+			nameIdx = i
+		} else if s == "value" && nameIdx != len(split) {
+			valueIdx = i
+			break
+		}
+	}
+	if nameIdx == len(split) {
+		return "", ""
+	}
+	name := strings.Join(split[nameIdx+1:valueIdx], " ")
+	value := ""
+	if valueIdx < len(split) {
+		value = strings.Join(split[valueIdx+1:], " ")
+	}
+	return name, value
 }
 
 // Return a new board.Board. Input can be in one of two formats: "position
-// startpos moves e2e4 e7e5" or "position fen ... moves e2e4"
-func buildPosition(split []string) *board.Board {
+// startpos moves e2e4 e7e5" or "position fen ... moves e2e4". If a move is
+// invalid, return the position before it and an error. If the position itself
+// is invalid, return nil and an error
+func buildPosition(split []string) (*board.Board, error) {
+	cb, _, err := buildGame(split)
+	return cb, err
+}
+
+// Like buildPosition, and also return the Zobrist hashes of the positions
+// before each move, oldest first
+func buildGame(split []string) (*board.Board, []uint64, error) {
 	var cb *board.Board
-	var movesIdx int
+	var history []uint64
+	movesIdx := len(split)
 	for i, s := range split {
 		if s == "moves" {
 			movesIdx = i
@@ -70,55 +242,73 @@ func buildPosition(split []string) *board.Board {
 		}
 	}
 
+	if len(split) < 2 {
+		return nil, nil, fmt.Errorf("position: want startpos or fen")
+	}
 	if split[1] == "fen" {
 		var err error
-		if movesIdx != 0 {
-			cb, err = board.FromFen(strings.Join(split[2:movesIdx], " "))
-		} else {
-			cb, err = board.FromFen(strings.Join(split[2:], " "))
+		cb, err = board.FromFen(strings.Join(split[2:movesIdx], " "))
+		if err == nil {
+			err = validatePosition(cb)
 		}
 		if err != nil {
-			// Invalid FEN, return empty board
-			log.Println("uci calling FromFen:", err) // TODO: remove
-			return cb
+			return nil, nil, fmt.Errorf("position: invalid fen: %w", err)
 		}
 	} else if split[1] == "startpos" {
 		cb = board.New()
 	} else {
-		return cb
+		return nil, nil, fmt.Errorf("position: want startpos or fen, got %s", split[1])
 	}
 
 	// Make moves, if provided
-	if movesIdx > 1 {
-		moves := split[movesIdx+1:]
-		for _, move := range moves {
-			fromSq, toSq, promoteTo, err := convertLongAlgebraicMoveToSquares(move)
-			pieceType, err := identifyPieceOnSquare(fromSq, cb)
-			if err != nil {
-				// Invalid move, return the board as-is
-				log.Println("uci identifying piece:", err) // TODO: remove
-				return cb
-			}
-
-			isValidMove := pieces.IsValidMove(fromSq, toSq, pieceType, cb)
-			if !isValidMove {
-				log.Printf("invalid move, to:%d, from:%d, piece:%d", toSq, fromSq, pieceType) // TODO: remove
-				return cb
-			}
+	for _, move := range split[min(movesIdx+1, len(split)):] {
+		fromSq, toSq, promoteTo, err := convertLongAlgebraicMoveToSquares(move)
+		if err != nil {
+			return cb, history, fmt.Errorf("position: %w", err)
+		}
+		pieceType, err := identifyPieceOnSquare(fromSq, cb)
+		if err != nil {
+			return cb, history, fmt.Errorf("position: %s: %w", move, err)
+		}
 
-			pieces.MovePiece(
-				board.Move{
-					From:      fromSq,
-					To:        toSq,
-					Piece:     pieceType,
-					PromoteTo: promoteTo,
-				},
-				cb,
-			)
+		key := cb.Zobrist
+		err = pieces.TryMovePiece(
+			board.Move{
+				From:      fromSq,
+				To:        toSq,
+				Piece:     pieceType,
+				PromoteTo: promoteTo,
+			},
+			cb,
+		)
+		if err != nil {
+			return cb, history, fmt.Errorf("position: %s: %w", move, err)
 		}
+		history = append(history, key)
 	}
 
-	return cb
+	return cb, history, nil
+}
+
+// Return an error if the engine cannot search the position
+func validatePosition(cb *board.Board) error {
+	for color := range 2 {
+		if kings := bits.OnesCount64(cb.Kings[color]); kings != 1 {
+			return fmt.Errorf("want one king per side, got %d", kings)
+		}
+	}
+	// Ranks 1 and 8
+	if (cb.Pawns[0]|cb.Pawns[1])&0xff000000000000ff != 0 {
+		return fmt.Errorf("pawn on the first or last rank")
+	}
+	if cb.Kings[1^cb.WToMove]&pieces.GetAttackedSquares(cb) != 0 {
+		return fmt.Errorf("the side not to move is in check")
+	}
+	// The pawn which just moved two squares passed rank 3 or rank 6
+	if epRanks := [2]int8{2, 5}; cb.EpSquare != 100 && cb.EpSquare/8 != epRanks[cb.WToMove] {
+		return fmt.Errorf("en passant square on the wrong rank for the side to move")
+	}
+	return nil
 }
 
 func identifyPieceOnSquare(square int8, cb *board.Board) (uint8, error) {
@@ -146,90 +336,195 @@ func identifyPieceOnSquare(square int8, cb *board.Board) (uint8, error) {
 	}
 }
 
-// Search the current position for the best move
-func calculate(split []string) {
-	options := buildGoOptions(split)
-	// All move in options.searchmoves should be legal when they are appended
-	// TODO: add stop channel for STOP command
-	// - use ticker in engine.go if needed, do not pass one in from here
-	engine.IterativeDeepening(currentPosition, int(options.depth), stop)
+// Search the current position for the best move in the background. A running
+// search is stopped first
+func (s *Session) calculate(split []string) {
+	s.stopSearch()
+	options, err := buildGoOptions(split, s.position)
+	if err != nil {
+		s.printError(err)
+	}
+	// All moves in options.searchmoves are legal when they are appended
+	limits := options.searchLimits()
+	limits.GameHistory = s.history
+	// Later position commands replace s.position, not the searched board
+	position := *s.position
+	s.ponderHit = nil
+	if options.ponder {
+		s.ponderHit = make(chan bool, 1)
+		limits.PonderHit = s.ponderHit
+	}
+
+	if len(pieces.GetLegalMoves(&position)) == 0 {
+		// Checkmate or stalemate: there is nothing to search
+		s.searches.stopAndWait()
+		if _, checks := pieces.GetCheckingSquares(&position); checks > 0 {
+			s.printf("info depth 0 score mate 0")
+		} else {
+			s.printf("info depth 0 score cp 0")
+		}
+		s.printf("bestmove 0000")
+		return
+	}
+	s.searches.start(func(stop chan bool) {
+		callbacks := engine.SearchCallbacks{Info: s.sendInfo, Progress: s.sendProgress}
+		ranked := s.engine.SearchRanked(&position, limits, callbacks, stop)
+		if len(ranked) == 0 {
+			s.printf("bestmove 0000")
+		} else if pv := ranked[0].PV; s.ponder && len(pv) > 1 {
+			// Expect the opponent to play the second PV move
+			s.printf("bestmove %s ponder %s", moveToString(pv[0]), moveToString(pv[1]))
+		} else {
+			s.printf("bestmove %s", moveToString(ranked[0].Move))
+		}
+	})
+}
+
+// Return the move in long algebraic notation. The null move is "0000"
+func moveToString(move board.Move) string {
+	if move == (board.Move{}) {
+		return "0000"
+	}
+	return engine.ConvertMovesToLongAlgebraic([]board.Move{move})[0]
+}
+
+// Report the result of an iteration to the GUI
+func (s *Session) sendInfo(info engine.SearchInfo) {
+	var line strings.Builder
+	fmt.Fprintf(&line, "info depth %d seldepth %d multipv %d", info.Depth, info.SelDepth, info.MultiPV)
+	if info.Mate != 0 {
+		fmt.Fprintf(&line, " score mate %d", info.Mate)
+	} else {
+		fmt.Fprintf(&line, " score cp %d", info.Eval)
+	}
+	fmt.Fprintf(&line, " nodes %d nps %d hashfull %d time %d pv",
+		info.Nodes, info.NPS, info.Hashfull, info.Time.Milliseconds())
+	for _, move := range engine.ConvertMovesToLongAlgebraic(info.PV) {
+		fmt.Fprintf(&line, " %s", move)
+	}
+	s.printf("%s", line.String())
+
+	if s.debug.Load() && info.MultiPV == 1 {
+		stats := info.Stats
+		s.printf("info string qnodes %d tthits %.1f%% cutoffs %.1f%% firstmovecutoffs %.1f%%",
+			stats.QNodes, stats.TTHitRate(), stats.BetaCutoffRate(), stats.FirstMoveCutoffRate())
+	}
+}
+
+// Report the root move being searched, with node counts, to the GUI
+func (s *Session) sendProgress(progress engine.SearchProgress) {
+	s.printf("info depth %d currmove %s currmovenumber %d nodes %d nps %d hashfull %d time %d",
+		progress.Depth, moveToString(progress.CurrMove), progress.CurrMoveNumber,
+		progress.Nodes, progress.NPS, progress.Hashfull, progress.Time.Milliseconds())
+}
+
+// Return the engine's search limits. Clock times are indexed [black, white]
+func (options goOptions) searchLimits() engine.SearchLimits {
+	return engine.SearchLimits{
+		Depth: int(options.depth),
+		Time: engine.TimeControl{
+			Time:      [2]int{int(options.btime), int(options.wtime)},
+			Inc:       [2]int{int(options.binc), int(options.winc)},
+			MovesToGo: int(options.movestogo),
+			MoveTime:  int(options.movetime),
+		},
+		Nodes:       options.nodes,
+		Mate:        int(options.mate),
+		Infinite:    options.infinite,
+		SearchMoves: options.searchmoves,
+	}
 }
 
 type goOptions struct {
 	searchmoves                                                       []board.Move
 	wtime, btime, binc, winc, movestogo, depth, nodes, mate, movetime uint64
-	infinite                                                          bool
+	infinite, ponder                                                  bool
 }
 
 // Parse options following the "go ..." command. Options include depth, nodes,
-// searchmoves, infinite, movestogo,
-func buildGoOptions(split []string) goOptions {
-	// TODO:
-	//   wtime 2000 btime 1000
-	//   binc 100 winc 100
-	//   mate 10 (mate search 10 moves deep, maybe 20 ply?
-	//   movetime 500 (search 500ms then return best move)
+// searchmoves, infinite, ponder, movestogo, wtime, btime, winc, binc, movetime, mate.
+// Invalid options are skipped and reported in the error
+func buildGoOptions(split []string, cb *board.Board) (goOptions, error) {
 	options := goOptions{}
+	errs := []error{}
 	for i, s := range split {
 		switch s {
 		case "infinite":
 			options.infinite = true
-		case "depth":
-			depth, err := strconv.ParseUint(split[i+1], 10, 0)
-			if err != nil {
-				log.Println("buildGoOptions depth:", err)
+		case "ponder":
+			options.ponder = true
+		case "depth", "nodes", "mate", "movestogo", "wtime", "btime", "winc", "binc", "movetime":
+			if i+1 == len(split) {
+				errs = append(errs, fmt.Errorf("go %s: missing value", s))
 				continue
 			}
-			options.depth = depth
-		case "nodes":
-			nodes, err := strconv.ParseUint(split[i+1], 10, 0)
+			n, err := strconv.ParseUint(split[i+1], 10, 0)
 			if err != nil {
-				log.Println("buildGoOptions nodes:", err)
+				errs = append(errs, fmt.Errorf("go %s: %w", s, err))
 				continue
 			}
-			options.nodes = nodes
-		case "movestogo":
-			movestogo, err := strconv.ParseUint(split[i+1], 10, 0)
-			if err != nil {
-				log.Println("buildGoOptions movestogo:", err)
-				continue
+			switch s {
+			case "depth":
+				options.depth = n
+			case "nodes":
+				options.nodes = n
+			case "mate":
+				options.mate = n
+			case "movestogo":
+				options.movestogo = n
+			// Milliseconds
+			case "wtime":
+				options.wtime = n
+			case "btime":
+				options.btime = n
+			case "winc":
+				options.winc = n
+			case "binc":
+				options.binc = n
+			case "movetime":
+				options.movetime = n
 			}
-			options.movestogo = movestogo
 		case "searchmoves":
-			// If an error occurs or an invalid move is submitted, stop adding moves
-			for idx := i + 1; ; idx++ {
+			// Moves continue until the next token which is not a move. Stop
+			// adding moves at an illegal move. Once a move is listed, only
+			// the legal listed moves are searched, which may be none
+			legalMoves := pieces.GetLegalMoves(cb)
+			for idx := i + 1; idx < len(split); idx++ {
 				fromSq, toSq, promoteTo, err := convertLongAlgebraicMoveToSquares(split[idx])
 				if err != nil {
 					break
 				}
-				currentPosition.Print()
-				pieceType, err := identifyPieceOnSquare(fromSq, currentPosition)
-				if err != nil {
-					break
+				if options.searchmoves == nil {
+					options.searchmoves = []board.Move{}
+				}
+				pieceType, err := identifyPieceOnSquare(fromSq, cb)
+				move := board.Move{
+					From:      fromSq,
+					To:        toSq,
+					Piece:     pieceType,
+					PromoteTo: promoteTo,
 				}
-				if pieces.IsValidMove(fromSq, toSq, pieceType, currentPosition) {
-					options.searchmoves = append(
-						options.searchmoves,
-						board.Move{
-							From:      fromSq,
-							To:        toSq,
-							Piece:     pieceType,
-							PromoteTo: promoteTo,
-						},
-					)
-				} else {
+				if err == nil && !slices.Contains(legalMoves, move) {
+					err = fmt.Errorf("not a legal move")
+				}
+				if err != nil {
+					errs = append(errs, fmt.Errorf("go searchmoves %s: %w", split[idx], err))
 					break
 				}
+				options.searchmoves = append(options.searchmoves, move)
 			}
 		}
 	}
 
-	return options
+	return options, errors.Join(errs...)
 }
 
 // Return fromSqare, toSquare, promoteTo, err. Input formats: "a1h8", "a7a8q"
 func convertLongAlgebraicMoveToSquares(move string) (int8, int8, uint8, error) {
 	// TODO: think about a way to streamline this func
+	if len(move) != 4 && len(move) != 5 {
+		return 0, 0, pieces.NO_PIECE, fmt.Errorf("invalid long algebraic move: %s", move)
+	}
 	fromSq := int8((move[1]-'1')*8 + move[0] - 'a')
 	toSq := int8((move[3]-'1')*8 + move[2] - 'a')
 	promoteTo := pieces.NO_PIECE
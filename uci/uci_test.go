@@ -1,11 +1,18 @@
 package uci
 
 import (
+	"bytes"
+	"io"
 	"reflect"
+	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/j1642/chess-engine-2/board"
+	"github.com/j1642/chess-engine-2/engine"
 	"github.com/j1642/chess-engine-2/pieces"
 )
 
@@ -17,22 +24,21 @@ func TestSetPosition(t *testing.T) {
 	// "position startpos moves e2e4 e7e5"
 	// "position fen ... moves e2e4"
 	newBoard := board.New()
-	kingsPawn, err := board.FromFen("rnbqkbnr/pppp1ppp/8/4p3/4P3/8/PPPP1PPP/RNBQKBNR w KQkq e6 1 3")
+	kingsPawn, err := board.FromFen("rnbqkbnr/pppp1ppp/8/4p3/4P3/8/PPPP1PPP/RNBQKBNR w KQkq e6 0 2")
 	if err != nil {
 		t.Error(err)
 	}
 	kingsPawn.PrevMove = board.Move{From: 52, To: 36, Piece: pieces.PAWN, PromoteTo: pieces.NO_PIECE}
-	kingsPawn.HalfMoves = 2
 
 	startFromFen := "position fen rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1"
-	actual1 := buildPosition(strings.Fields(startFromFen))
-	actual2 := buildPosition(strings.Fields("position startpos"))
+	actual1, _ := buildPosition(strings.Fields(startFromFen))
+	actual2, _ := buildPosition(strings.Fields("position startpos"))
 
-	actual3 := buildPosition(strings.Fields(startFromFen + " moves"))
-	actual4 := buildPosition(strings.Fields("position startpos moves"))
+	actual3, _ := buildPosition(strings.Fields(startFromFen + " moves"))
+	actual4, _ := buildPosition(strings.Fields("position startpos moves"))
 
-	actual5 := buildPosition(strings.Fields(startFromFen + " moves e2e4 e7e5"))
-	actual6 := buildPosition(strings.Fields("position startpos moves e2e4 e7e5"))
+	actual5, _ := buildPosition(strings.Fields(startFromFen + " moves e2e4 e7e5"))
+	actual6, _ := buildPosition(strings.Fields("position startpos moves e2e4 e7e5"))
 
 	tests := []setPositionTestCase{
 		{
@@ -82,6 +88,72 @@ func TestSetPosition(t *testing.T) {
 	}
 }
 
+func TestSetPositionStopsAtIllegalMove(t *testing.T) {
+	// A promotion without a promotion piece is rejected instead of asking for input
+	cb, err := buildPosition(strings.Fields("position fen 8/P7/8/8/8/8/8/k6K w - - 0 1 moves a7a8"))
+	if err == nil {
+		t.Error("a7a8 without a promotion piece: want an error")
+	}
+	if cb.Pawns[1] != uint64(1<<48) || cb.WToMove != 1 {
+		t.Errorf("a7a8 without a promotion piece was played")
+	}
+
+	// Moves after the first illegal move are ignored
+	cb, err = buildPosition(strings.Fields("position startpos moves e2e4 e7e4 d2d4"))
+	if err == nil {
+		t.Error("e7e4: want an error")
+	}
+	expected, _ := buildPosition(strings.Fields("position startpos moves e2e4"))
+	if *cb != *expected {
+		t.Errorf("moves after the illegal e7e4 were played")
+	}
+}
+
+func TestBuildGameHistory(t *testing.T) {
+	cb, history, err := buildGame(strings.Fields("position startpos moves g1f3 g8f6 f3g1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint64{}
+	for _, position := range []string{"position startpos", "position startpos moves g1f3", "position startpos moves g1f3 g8f6"} {
+		before, _ := buildPosition(strings.Fields(position))
+		want = append(want, before.Zobrist)
+	}
+	if !slices.Equal(history, want) {
+		t.Errorf("want history=%v, got %v", want, history)
+	}
+	// f6g8 would repeat the starting position
+	if cb.HalfMoves != 3 || history[0] != board.New().Zobrist {
+		t.Errorf("want HalfMoves=3 and the starting position first, got %d, %v", cb.HalfMoves, history)
+	}
+}
+
+func TestPositionWithLongHalfmoveClock(t *testing.T) {
+	// Clocks past the fifty-move rule come from long games or edited FENs
+	cb, _, err := buildGame(strings.Fields("position fen 4k3/8/8/8/8/8/8/Q3K3 w - - 300 200 moves a1a2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cb.HalfMoves != 255 {
+		t.Errorf("want HalfMoves=255, got %d", cb.HalfMoves)
+	}
+}
+
+func TestPositionWithoutEnPassantField(t *testing.T) {
+	for _, position := range []string{
+		"position fen 4k3/8/8/8/8/8/4P3/4K3 w K",
+		"position fen 4k3/8/8/8/8/8/4P3/4K3 w 0 moves e2e4 e8d8",
+	} {
+		cb, err := buildPosition(strings.Fields(position))
+		if err != nil {
+			t.Fatalf("%q: %v", position, err)
+		}
+		if cb.EpSquare != 100 {
+			t.Errorf("%q: want no en passant square, got %d", position, cb.EpSquare)
+		}
+	}
+}
+
 type moveConversionTestCase struct {
 	expectedTo, expectedFrom int8
 	expectedPromoteTo        uint8
@@ -89,7 +161,6 @@ type moveConversionTestCase struct {
 }
 
 func TestConvertLongAlgebraicMoveToSquares(t *testing.T) {
-	// TODO: add test cases where error != nil, test for != nil
 	tests := []moveConversionTestCase{
 		{
 			// Normal move
@@ -115,11 +186,20 @@ func TestConvertLongAlgebraicMoveToSquares(t *testing.T) {
 			t.Error(err)
 		}
 	}
+
+	for _, input := range []string{"", "e", "e2e", "e2e4qq", "i2e4", "e9e4", "e7e8k"} {
+		if _, _, _, err := convertLongAlgebraicMoveToSquares(input); err == nil {
+			t.Errorf("%q: want an error", input)
+		}
+	}
 }
 
 func TestBuildGoOptions(t *testing.T) {
 	split := strings.Fields("go infinite depth 5 searchmoves d2d3 nodes 1000")
-	actual := buildGoOptions(split)
+	actual, err := buildGoOptions(split, board.New())
+	if err != nil {
+		t.Error(err)
+	}
 	expected := goOptions{
 		depth:       5,
 		nodes:       1000,
@@ -146,3 +226,437 @@ func TestBuildGoOptions(t *testing.T) {
 		t.Error("nodes")
 	}
 }
+
+func TestBuildGoOptionsPinnedSearchMove(t *testing.T) {
+	cb, err := board.FromFen("4k3/4r3/8/8/8/8/4N3/4K3 w - - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The pinned knight's move is pseudo-legal only
+	options, err := buildGoOptions(strings.Fields("go searchmoves e2c3"), cb)
+	if err == nil {
+		t.Error("e2c3: want an error")
+	}
+	// The search is still restricted to the listed moves
+	if options.searchmoves == nil || len(options.searchmoves) != 0 {
+		t.Errorf("want empty searchmoves, got %v", options.searchmoves)
+	}
+}
+
+func TestSearchLimits(t *testing.T) {
+	split := strings.Fields("go wtime 60000 btime 30000 winc 1000 binc 500 movestogo 20")
+	expected := engine.SearchLimits{
+		Time: engine.TimeControl{
+			Time:      [2]int{30000, 60000},
+			Inc:       [2]int{500, 1000},
+			MovesToGo: 20,
+		},
+	}
+	if actual := mustGoOptions(t, split).searchLimits(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("clock: want=%v, got=%v", expected, actual)
+	}
+
+	split = strings.Fields("go infinite nodes 1000 mate 3")
+	expected = engine.SearchLimits{Nodes: 1000, Mate: 3, Infinite: true}
+	if actual := mustGoOptions(t, split).searchLimits(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("limits: want=%v, got=%v", expected, actual)
+	}
+
+	split = strings.Fields("go movetime 500")
+	if actual := mustGoOptions(t, split).searchLimits(); actual.Time.MoveTime != 500 {
+		t.Errorf("movetime: want=500, got=%d", actual.Time.MoveTime)
+	}
+}
+
+func mustGoOptions(t *testing.T, split []string) goOptions {
+	t.Helper()
+	options, err := buildGoOptions(split, board.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return options
+}
+
+type setOptionTestCase struct {
+	input, name, value string
+}
+
+func TestParseSetOption(t *testing.T) {
+	tests := []setOptionTestCase{
+		{input: "setoption name Hash value 64", name: "Hash", value: "64"},
+		{input: "setoption name Clear Hash", name: "Clear Hash", value: ""},
+		{input: "setoption name Eval File value my file.nnue", name: "Eval File", value: "my file.nnue"},
+		{input: "setoption value 5", name: "", value: ""},
+	}
+
+	for _, tt := range tests {
+		name, value := parseSetOption(strings.Fields(tt.input))
+		if name != tt.name || value != tt.value {
+			t.Errorf("%q: want=%q,%q got=%q,%q", tt.input, tt.name, tt.value, name, value)
+		}
+	}
+}
+
+// Fields which depend on the speed of the machine
+var timingFields = regexp.MustCompile(` (nps|time) \d+`)
+
+// Process commands in a new session and return its output without timing
+// fields. Each search runs to completion before the next command
+func runTranscript(commands []string) string {
+	var out bytes.Buffer
+	s := NewSession(strings.NewReader(""), &out)
+	for _, command := range commands {
+		s.ProcessMessage(command)
+		if strings.HasPrefix(command, "go") {
+			s.searches.wait()
+		}
+	}
+	return timingFields.ReplaceAllString(out.String(), "")
+}
+
+type transcriptTestCase struct {
+	name     string
+	commands []string
+	expected string
+}
+
+var transcriptTests = []transcriptTestCase{
+	{
+		name:     "handshake",
+		commands: []string{"uci", "isready"},
+		expected: `id name chess-engine-2
+id author j1642
+option name Hash type spin default 16 min 1 max 32768
+option name Clear Hash type button
+option name Threads type spin default 1 min 1 max 256
+option name Move Overhead type spin default 10 min 0 max 5000
+option name MultiPV type spin default 1 min 1 max 256
+option name Ponder type check default false
+option name Contempt type spin default 0 min -100 max 100
+option name UCI_AnalyseMode type check default false
+uciok
+readyok
+`,
+	},
+	{
+		name:     "search after moves",
+		commands: []string{"position startpos moves e2e4", "go depth 3"},
+		expected: `info depth 1 seldepth 3 multipv 1 score cp 0 nodes 31 hashfull 0 pv e7e5
+info depth 2 seldepth 6 multipv 1 score cp -23 nodes 249 hashfull 0 pv d7d5 e4e5 c7c6
+info depth 3 seldepth 8 multipv 1 score cp -20 nodes 658 hashfull 0 pv d7d5 d1h5 d5e4
+bestmove d7d5
+`,
+	},
+	{
+		name:     "mate",
+		commands: []string{"position fen 6k1/5ppp/8/8/8/8/5PPP/R5K1 w - - 0 1", "go depth 2"},
+		expected: `info depth 1 seldepth 1 multipv 1 score mate 1 nodes 26 hashfull 0 pv a1a8
+info depth 2 seldepth 1 multipv 1 score mate 1 nodes 47 hashfull 0 pv a1a8
+bestmove a1a8
+`,
+	},
+	{
+		name:     "option and second search",
+		commands: []string{"setoption name Hash value 1", "position startpos", "go depth 2", "ucinewgame", "go depth 1"},
+		expected: `info depth 1 seldepth 1 multipv 1 score cp 92 nodes 26 hashfull 1 pv e2e4
+info depth 2 seldepth 4 multipv 1 score cp 0 nodes 118 hashfull 1 pv e2e4 e7e5
+bestmove e2e4
+info depth 1 seldepth 1 multipv 1 score cp 92 nodes 26 hashfull 1 pv e2e4
+bestmove e2e4
+`,
+	},
+	{
+		name:     "multipv",
+		commands: []string{"setoption name MultiPV value 3", "position fen 6k1/5ppp/8/8/8/8/5PPP/R5K1 w - - 0 1", "go depth 2"},
+		expected: `info depth 1 seldepth 1 multipv 1 score mate 1 nodes 45 hashfull 0 pv a1a8
+info depth 1 seldepth 1 multipv 2 score cp 645 nodes 45 hashfull 0 pv a1a6
+info depth 1 seldepth 1 multipv 3 score cp 641 nodes 45 hashfull 0 pv a1a5
+info depth 2 seldepth 4 multipv 1 score mate 1 nodes 225 hashfull 1 pv a1a8
+info depth 2 seldepth 4 multipv 2 score cp 627 nodes 225 hashfull 1 pv a1a5 g8f8
+info depth 2 seldepth 4 multipv 3 score cp 617 nodes 225 hashfull 1 pv a1a6 g7g5
+bestmove a1a8
+`,
+	},
+	{
+		name:     "searchmoves",
+		commands: []string{"position startpos", "go depth 2 searchmoves a2a3 g1f3"},
+		expected: `info depth 1 seldepth 1 multipv 1 score cp 9 nodes 3 hashfull 0 pv a2a3
+info depth 2 seldepth 2 multipv 1 score cp -83 nodes 52 hashfull 0 pv a2a3 e7e5
+bestmove a2a3
+`,
+	},
+	{
+		name:     "ponder move",
+		commands: []string{"setoption name Ponder value true", "position startpos moves e2e4", "go depth 3"},
+		expected: `info depth 1 seldepth 3 multipv 1 score cp 0 nodes 31 hashfull 0 pv e7e5
+info depth 2 seldepth 6 multipv 1 score cp -23 nodes 249 hashfull 0 pv d7d5 e4e5 c7c6
+info depth 3 seldepth 8 multipv 1 score cp -20 nodes 658 hashfull 0 pv d7d5 d1h5 d5e4
+bestmove d7d5 ponder d1h5
+`,
+	},
+	{
+		name:     "mated in one",
+		commands: []string{"position fen k7/8/1K6/8/8/8/8/7R b - - 0 1", "go depth 2"},
+		expected: `info depth 1 seldepth 1 multipv 1 score cp -695 nodes 2 hashfull 0 pv a8b8
+info depth 2 seldepth 2 multipv 1 score mate -1 nodes 27 hashfull 0 pv a8b8 h1h8
+bestmove a8b8
+`,
+	},
+	{
+		// Kg7 repeats the position after the first move
+		name:     "repetition",
+		commands: []string{"position fen 8/6k1/8/8/8/8/8/KQ6 w - - 0 1 moves b1a2 g7h8 a2b1", "go depth 3"},
+		expected: `info depth 1 seldepth 1 multipv 1 score cp 0 nodes 2 hashfull 0 pv h8g7
+info depth 2 seldepth 1 multipv 1 score cp 0 nodes 4 hashfull 0 pv h8g7
+info depth 3 seldepth 1 multipv 1 score cp 0 nodes 6 hashfull 0 pv h8g7
+bestmove h8g7
+`,
+	},
+	{
+		// The draw is worth -Contempt to the engine, and 0 in analysis mode
+		name: "contempt",
+		commands: []string{
+			"setoption name Contempt value 40",
+			"position fen 8/6k1/8/8/8/8/8/KQ6 w - - 0 1 moves b1a2 g7h8 a2b1",
+			"go depth 1",
+			"setoption name UCI_AnalyseMode value true",
+			"ucinewgame",
+			"go depth 1",
+		},
+		expected: `info depth 1 seldepth 1 multipv 1 score cp -40 nodes 2 hashfull 0 pv h8g7
+bestmove h8g7
+info depth 1 seldepth 1 multipv 1 score cp 0 nodes 2 hashfull 0 pv h8g7
+bestmove h8g7
+`,
+	},
+	{
+		name:     "mate in two",
+		commands: []string{"position fen k7/8/2K5/8/8/8/8/7R w - - 0 1", "go depth 3"},
+		expected: `info depth 1 seldepth 1 multipv 1 score cp 789 nodes 26 hashfull 0 pv h1h8
+info depth 2 seldepth 4 multipv 1 score cp 732 nodes 99 hashfull 0 pv h1h8 a8a7 h8e8
+info depth 3 seldepth 5 multipv 1 score mate 2 nodes 412 hashfull 0 pv c6b6 a8b8 h1h8
+bestmove c6b6
+`,
+	},
+	{
+		name:     "debug statistics",
+		commands: []string{"debug on", "position startpos", "go depth 2", "debug off", "go depth 1"},
+		expected: `info depth 1 seldepth 1 multipv 1 score cp 92 nodes 26 hashfull 0 pv e2e4
+info string qnodes 25 tthits 0.0% cutoffs 0.0% firstmovecutoffs 0.0%
+info depth 2 seldepth 4 multipv 1 score cp 0 nodes 118 hashfull 0 pv e2e4 e7e5
+info string qnodes 95 tthits 18.6% cutoffs 82.6% firstmovecutoffs 78.9%
+bestmove e2e4
+info depth 1 seldepth 1 multipv 1 score cp 92 nodes 4 hashfull 0 pv e2e4
+bestmove e2e4
+`,
+	},
+}
+
+var errorTranscriptTests = []transcriptTestCase{
+	{
+		name:     "empty lines and unknown tokens",
+		commands: []string{"", "   ", "joho isready", "joho debug on", "foo bar"},
+		expected: "readyok\n",
+	},
+	{
+		name: "invalid commands",
+		commands: []string{
+			"position startpos moves e2e4 e7e4",
+			"position fen nonsense",
+			"position fen 8/8/8/8/8/8/8/8 w - - 0 1",
+			"position fen k7/8/8/8/8/8/8/R6K w - - 0 1",
+			"position fen 4k3/8/8/8/8/8/4P3/4K3 w - e3 0 1",
+			"position",
+			"go depth x depth 1 movetime",
+			"setoption name Nope value 1",
+		},
+		expected: `info string position: e7e4: illegal move {52 28 0 9}
+info string position: invalid fen: invalid FEN string
+info string position: invalid fen: want one king per side, got 0
+info string position: invalid fen: the side not to move is in check
+info string position: invalid fen: en passant square on the wrong rank for the side to move
+info string position: want startpos or fen
+info string go depth: strconv.ParseUint: parsing "x": invalid syntax
+info string go movetime: missing value
+info depth 1 seldepth 3 multipv 1 score cp 0 nodes 31 hashfull 0 pv e7e5
+bestmove e7e5
+info string setoption: no such option: Nope
+`,
+	},
+	{
+		// The knight is pinned, so no listed move is legal and nothing is searched
+		name:     "illegal searchmoves",
+		commands: []string{"position fen 4k3/4r3/8/8/8/8/4N3/4K3 w - - 0 1", "go depth 2 searchmoves e2c3"},
+		expected: "info string go searchmoves e2c3: not a legal move\nbestmove 0000\n",
+	},
+	{
+		name:     "checkmate",
+		commands: []string{"position startpos moves f2f3 e7e5 g2g4 d8h4", "go depth 3"},
+		expected: "info depth 0 score mate 0\nbestmove 0000\n",
+	},
+	{
+		name:     "stalemate",
+		commands: []string{"position fen k7/2Q5/1K6/8/8/8/8/8 b - - 0 1", "go depth 3"},
+		expected: "info depth 0 score cp 0\nbestmove 0000\n",
+	},
+}
+
+func TestSessionTranscripts(t *testing.T) {
+	for _, tt := range append(transcriptTests, errorTranscriptTests...) {
+		if actual := runTranscript(tt.commands); actual != tt.expected {
+			t.Errorf("%s:\nwant:\n%s\ngot:\n%s", tt.name, tt.expected, actual)
+		}
+	}
+}
+
+func TestSessionsAreIndependent(t *testing.T) {
+	// Concurrent sessions have separate positions and hash tables, so each
+	// matches its transcript
+	var wg sync.WaitGroup
+	for _, tt := range transcriptTests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if actual := runTranscript(tt.commands); actual != tt.expected {
+				t.Errorf("%s:\nwant:\n%s\ngot:\n%s", tt.name, tt.expected, actual)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSessionRun(t *testing.T) {
+	var out bytes.Buffer
+	input := "isready\nposition startpos\ngo infinite\nisready\nstop\nstop\nquit\nisready\n"
+	if err := NewSession(strings.NewReader(input), &out).Run(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	// readyok before and during the search, one bestmove for two stops, and
+	// no output after quit
+	readyoks, bestmoves := 0, 0
+	for _, line := range lines {
+		if line == "readyok" {
+			readyoks++
+		} else if strings.HasPrefix(line, "bestmove") {
+			bestmoves++
+		}
+	}
+	if readyoks != 2 {
+		t.Errorf("readyok count: want=2, got=%d", readyoks)
+	}
+	if bestmoves != 1 || !strings.HasPrefix(lines[len(lines)-1], "bestmove") {
+		t.Errorf("want exactly one bestmove as the last line, got:\n%s", out.String())
+	}
+}
+
+func TestSessionRunStopsAtEOF(t *testing.T) {
+	// Input ends during an infinite search without stop or quit
+	var out bytes.Buffer
+	input := "position startpos\ngo infinite"
+	if err := NewSession(strings.NewReader(input), &out).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "bestmove") {
+		t.Errorf("want a bestmove after EOF, got:\n%s", out.String())
+	}
+}
+
+func FuzzProcessMessage(f *testing.F) {
+	f.Add("position startpos moves e2e4 e7e5")
+	f.Add("position fen 8/P7/8/8/8/8/8/k6K w - - 0 1 moves a7a8q")
+	f.Add("go depth 1 searchmoves e2e4")
+	f.Add("setoption name Hash value 1")
+	f.Add("joho debug on")
+	f.Add("go wtime")
+	s := NewSession(strings.NewReader(""), io.Discard)
+	f.Fuzz(func(t *testing.T, msg string) {
+		// Keep searches short. Any search still running is stopped
+		if strings.Contains(msg, "go") {
+			msg += " depth 1"
+		}
+		s.ProcessMessage(msg)
+		s.searches.stopAndWait()
+	})
+}
+
+func FuzzBuildPosition(f *testing.F) {
+	f.Add("position startpos moves e2e4 e7e5 g1f3")
+	f.Add("position fen rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1 moves e2e4")
+	f.Add("position fen 8/8/8")
+	f.Fuzz(func(t *testing.T, msg string) {
+		cb, err := buildPosition(strings.Fields(msg))
+		if cb == nil && err == nil {
+			t.Errorf("%q: no position and no error", msg)
+		}
+	})
+}
+
+func FuzzBuildGoOptions(f *testing.F) {
+	f.Add("go infinite depth 5 searchmoves d2d3 nodes 1000")
+	f.Add("go wtime 1000 btime -5 movestogo")
+	f.Fuzz(func(t *testing.T, msg string) {
+		buildGoOptions(strings.Fields(msg), board.New())
+	})
+}
+
+func FuzzConvertLongAlgebraicMoveToSquares(f *testing.F) {
+	f.Add("e2e4")
+	f.Add("e7e8q")
+	f.Add("a")
+	f.Fuzz(func(t *testing.T, move string) {
+		fromSq, toSq, _, err := convertLongAlgebraicMoveToSquares(move)
+		if err == nil && (fromSq < 0 || fromSq > 63 || toSq < 0 || toSq > 63) {
+			t.Errorf("%q: squares %d, %d are off the board", move, fromSq, toSq)
+		}
+	})
+}
+
+func FuzzParseSetOption(f *testing.F) {
+	f.Add("setoption name Hash value 64")
+	f.Add("setoption value name")
+	f.Fuzz(func(t *testing.T, msg string) {
+		parseSetOption(strings.Fields(msg))
+	})
+}
+
+// Return the session's output so far. The search may still be writing
+func (s *Session) output(out *bytes.Buffer) string {
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	return out.String()
+}
+
+func TestPonder(t *testing.T) {
+	for _, end := range []string{"ponderhit", "stop"} {
+		var out bytes.Buffer
+		s := NewSession(strings.NewReader(""), &out)
+		s.ProcessMessage("position startpos moves e2e4 e7e5")
+		s.ProcessMessage("go ponder depth 2 wtime 100000 btime 100000")
+		// The search reaches its depth, but waits for the end of the ponder
+		time.Sleep(100 * time.Millisecond)
+		if strings.Contains(s.output(&out), "bestmove") {
+			t.Errorf("%s: bestmove before the ponder ended", end)
+		}
+		s.ProcessMessage(end)
+		s.searches.wait()
+		if !strings.Contains(s.output(&out), "bestmove") {
+			t.Errorf("%s: no bestmove after the ponder ended", end)
+		}
+	}
+}
+
+func TestInfoTimingFields(t *testing.T) {
+	var out bytes.Buffer
+	s := NewSession(strings.NewReader(""), &out)
+	s.ProcessMessage("position startpos")
+	s.ProcessMessage("go depth 2")
+	s.searches.wait()
+	info := regexp.MustCompile(`^info depth \d+ seldepth \d+ multipv 1 score cp -?\d+ nodes \d+ nps \d+ hashfull \d+ time \d+ pv( [a-h][1-8][a-h][1-8])+$`)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	for _, line := range lines[:len(lines)-1] {
+		if !info.MatchString(line) {
+			t.Errorf("malformed info line: %q", line)
+		}
+	}
+}